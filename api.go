@@ -1,63 +1,200 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 )
 
 type Api struct {
 	Router *mux.Router
 	DB     Database
+	// ready is 1 while the API is serving and should be sent requests
+	ready int32
 }
 
-func (api *Api) Initialise() {
-	loadConfig()
+// Initialise loads the config, applying any of the config flags which were
+// set on flags, sets up the routes and connects to the database.
+func (api *Api) Initialise(flags *flag.FlagSet) {
+	loadConfig(flags)
 	api.initialiseRouter()
 	api.initialiseDatabase()
 }
 
+// Run serves the API until it gets SIGINT or SIGTERM. It then stops taking
+// new requests, waits for those in flight and only then disconnects from the
+// database, before exiting.
 func (api *Api) Run() {
-	exitCode := 0
-	defer func() { os.Exit(exitCode) }()
-	defer api.DB.Disconnect()
+	server := api.newServer()
+	certFile, keyFile := viper.GetString("Server.Tls.CertFile"), viper.GetString("Server.Tls.KeyFile")
+	if (certFile == "") != (keyFile == "") {
+		log.Println("Error while running API: Server.Tls needs both a CertFile and a KeyFile")
+		api.disconnectDatabase()
+		os.Exit(1)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Bind before reporting ready, so that probes never see a ready API which
+	// can't take requests
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Println("Error while running API: ", err)
+		api.disconnectDatabase()
+		os.Exit(1)
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		if certFile != "" {
+			log.Printf("Listening for HTTPS on %v\n", listener.Addr())
+			serveErr <- server.ServeTLS(listener, certFile, keyFile)
+			return
+		}
+		log.Printf("Listening for HTTP on %v\n", listener.Addr())
+		serveErr <- server.Serve(listener)
+	}()
+	api.setReady(true)
 
-	if err := http.ListenAndServe(":8081", api.Router); err != nil {
+	exitCode := 0
+	select {
+	case err := <-serveErr:
 		log.Println("Error while running API: ", err)
 		exitCode = 1
-		return
+	case <-ctx.Done():
+		// A second signal stops the process without waiting
+		stop()
+		if err := api.shutdown(server); err != nil {
+			log.Println("Error while shutting down API: ", err)
+			exitCode = 1
+		}
 	}
+	api.disconnectDatabase()
+	os.Exit(exitCode)
 }
 
-func loadConfig() {
-	viper.SetConfigName("config")
-	viper.AddConfigPath("./config/")
-	err := viper.ReadInConfig()
-	if err != nil {
-		log.Println("Error while loading config from file: ", err)
-		os.Exit(1)
+func (api *Api) newServer() *http.Server {
+	return &http.Server{
+		Addr:           viper.GetString("Server.Address"),
+		Handler:        api.Router,
+		ReadTimeout:    viper.GetDuration("Server.ReadTimeout"),
+		WriteTimeout:   viper.GetDuration("Server.WriteTimeout"),
+		IdleTimeout:    viper.GetDuration("Server.IdleTimeout"),
+		MaxHeaderBytes: viper.GetInt("Server.MaxHeaderBytes"),
 	}
 }
 
+// shutdown reports the API as not ready, waits for load balancers to notice
+// and then drains server. Requests still running after the drain timeout are
+// cut off.
+func (api *Api) shutdown(server *http.Server) error {
+	log.Println("Shutting down API...")
+	api.setReady(false)
+	if delay := viper.GetDuration("Server.ShutdownDelay"); delay > 0 {
+		log.Printf("Waiting %v before draining connections\n", delay)
+		time.Sleep(delay)
+	}
+
+	ctx := context.Background()
+	if timeout := viper.GetDuration("Server.DrainTimeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		server.Close()
+		return errors.Wrap(err, "draining connections failed")
+	}
+	log.Println("Shut down API.")
+	return nil
+}
+
+func (api *Api) setReady(ready bool) {
+	value := int32(0)
+	if ready {
+		value = 1
+	}
+	atomic.StoreInt32(&api.ready, value)
+}
+
+func (api *Api) isReady() bool {
+	return atomic.LoadInt32(&api.ready) == 1
+}
+
 func (api *Api) initialiseRouter() {
 	api.Router = mux.NewRouter()
+	api.Router.Use(validateRequests)
+
+	// These choose their format without the Accept header
+	api.Router.HandleFunc("/openapi.json", api.getOpenApiSpec).Methods("GET")
+	api.Router.HandleFunc("/plants/export", api.exportPlants).Methods("GET")
+	if viper.GetBool("OpenApi.DocsUi") {
+		api.Router.HandleFunc("/docs", api.getDocs).Methods("GET")
+	}
 
-	api.Router.HandleFunc("/plants", api.listPlants).Methods("GET")
-	api.Router.HandleFunc("/plants/{id}", api.getPlant).Methods("GET")
-	api.Router.HandleFunc("/plants", api.postPlant).Methods("POST")
-	api.Router.HandleFunc("/plants/{id}", api.putPlant).Methods("PUT")
-	api.Router.HandleFunc("/plants/{id}", api.deletePlant).Methods("DELETE")
+	// Probes get a response whatever they accept
+	api.Router.HandleFunc("/healthz", api.getHealth).Methods("GET")
+	api.Router.HandleFunc("/readyz", api.getReadiness).Methods("GET")
+
+	routes := api.Router.NewRoute().Subrouter()
+	routes.Use(negotiateContent)
+	routes.HandleFunc("/vocabulary", api.getVocabulary).Methods("GET")
+	routes.HandleFunc("/plants", api.listPlants).Methods("GET")
+	routes.HandleFunc("/plants/search", api.searchPlants).Methods("GET")
+	routes.HandleFunc("/plants/suggest", api.suggestPlants).Methods("GET")
+	routes.HandleFunc("/plants/trash", api.listTrash).Methods("GET")
+	routes.HandleFunc("/plants/trash/{id}", api.purgePlant).Methods("DELETE")
+	routes.HandleFunc("/plants/by-slug/{slug}", api.getPlantBySlug).Methods("GET")
+	routes.HandleFunc("/plants/{id}", api.getPlant).Methods("GET")
+	routes.HandleFunc("/plants", api.postPlant).Methods("POST")
+	routes.HandleFunc("/plants:batch", api.postPlantBatch).Methods("POST")
+	routes.HandleFunc("/plants:import", api.importPlants).Methods("POST")
+	routes.HandleFunc("/plants/{id}", api.putPlant).Methods("PUT")
+	routes.HandleFunc("/plants/{id}", api.patchPlant).Methods("PATCH")
+	routes.HandleFunc("/plants/{id}", api.deletePlant).Methods("DELETE")
+	routes.HandleFunc("/plants/{id}/restore", api.restorePlant).Methods("POST")
+	routes.HandleFunc("/plants/{id}/history", api.getPlantHistory).Methods("GET")
+	routes.HandleFunc("/plants/{id}/history/{rev}", api.getPlantRevision).Methods("GET")
+	routes.HandleFunc("/plants/{id}/history/{rev}/revert", api.revertPlant).Methods("POST")
 }
 
 func (api *Api) initialiseDatabase() {
-	dbName := viper.GetString("MongoDb.DbName")
-	collectionName := viper.GetString("MongoDb.CollectionName")
-	api.DB = &MongoDb{DbName: dbName, CollectionName: collectionName}
-	if err := api.DB.Connect(); err != nil {
-		log.Println("Error while connecting to MongoDB: ", err)
+	switch dbType := viper.GetString("Database.Type"); dbType {
+	case "", "mongodb":
+		dbName := viper.GetString("MongoDb.DbName")
+		collectionName := viper.GetString("MongoDb.CollectionName")
+		api.DB = &MongoDb{DbName: dbName, CollectionName: collectionName}
+	case "bolt":
+		api.DB = &BoltDb{Path: viper.GetString("BoltDb.Path")}
+	case "memory":
+		api.DB = &MemoryDb{}
+	default:
+		log.Printf("Unknown database type '%v' in config\n", dbType)
+		os.Exit(1)
+	}
+
+	ctx, cancel := dbContext(context.Background(), dbOperationConnect)
+	defer cancel()
+	if err := api.DB.Connect(ctx); err != nil {
+		log.Println("Error while connecting to database: ", err)
 		os.Exit(1)
 	}
 }
+
+func (api *Api) disconnectDatabase() {
+	ctx, cancel := dbContext(context.Background(), dbOperationConnect)
+	defer cancel()
+	if err := api.DB.Disconnect(ctx); err != nil {
+		log.Println("Error while disconnecting from database: ", err)
+	}
+}
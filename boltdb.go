@@ -0,0 +1,628 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	plantsBucket         = []byte("plants")
+	plantNamesBucket     = []byte("plantNames")
+	plantRevisionsBucket = []byte("plantRevisions")
+)
+
+// defaultBoltOpenTimeout bounds opening the file when there is no deadline.
+const defaultBoltOpenTimeout = 5 * time.Second
+
+type BoltDb struct {
+	Driver *bolt.DB
+	Path   string
+}
+
+func (db *BoltDb) Connect(ctx context.Context) error {
+	log.Printf("Opening BoltDB file %v...\n", db.Path)
+	if err := os.MkdirAll(filepath.Dir(db.Path), 0755); err != nil {
+		return errors.Wrap(err, "BoltDB directory creation failed")
+	}
+
+	// Opening waits for the file lock, which another process may hold, until
+	// the deadline of ctx
+	timeout := defaultBoltOpenTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return errors.Wrap(context.DeadlineExceeded, "BoltDB open failed")
+		}
+	}
+	driver, err := bolt.Open(db.Path, 0600, &bolt.Options{Timeout: timeout})
+	if err != nil {
+		return errors.Wrap(err, "BoltDB open failed")
+	}
+
+	// Buckets play the role of the collection and its unique index on the
+	// names of Plants which haven't been deleted, plus the revision history
+	err = driver.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{plantsBucket, plantNamesBucket, plantRevisionsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		driver.Close()
+		return errors.Wrap(err, "BoltDB bucket creation failed")
+	}
+
+	db.Driver = driver
+	log.Println("Opened BoltDB file.")
+	return nil
+}
+
+func (db *BoltDb) Disconnect(ctx context.Context) error {
+	log.Println("Closing BoltDB file...")
+	if err := db.Driver.Close(); err != nil {
+		return err
+	}
+	log.Println("Closed BoltDB file.")
+	return nil
+}
+
+// Ping checks that the file is open, by starting a read transaction.
+func (db *BoltDb) Ping(ctx context.Context) error {
+	if err := db.view(ctx, func(tx *bolt.Tx) error { return nil }); err != nil {
+		return errors.Wrap(err, "BoltDB view failed")
+	}
+	return nil
+}
+
+// view and update run fn in a transaction, unless ctx is done. BoltDB can't
+// interrupt a transaction, so ctx is checked once it has started, as waiting
+// for the write lock may have used up the deadline.
+func (db *BoltDb) view(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	return db.Driver.View(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+func (db *BoltDb) update(ctx context.Context, fn func(tx *bolt.Tx) error) error {
+	return db.Driver.Update(func(tx *bolt.Tx) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
+
+func (db *BoltDb) GetAllPlants(ctx context.Context) ([]Plant, error) {
+	log.Println("Finding all Plants in BoltDB")
+	plants, err := db.plantsWhere(ctx, func(plant Plant) bool { return plant.DeletedAt == nil })
+	if err != nil {
+		return []Plant{}, err
+	}
+
+	log.Println("Retrieved all Plants from BoltDB. Item count: ", len(plants))
+	return plants, nil
+}
+
+func (db *BoltDb) GetDeletedPlants(ctx context.Context) ([]Plant, error) {
+	log.Println("Finding deleted Plants in BoltDB")
+	plants, err := db.plantsWhere(ctx, func(plant Plant) bool { return plant.DeletedAt != nil })
+	if err != nil {
+		return []Plant{}, err
+	}
+
+	log.Println("Retrieved deleted Plants from BoltDB. Item count: ", len(plants))
+	return plants, nil
+}
+
+func (db *BoltDb) GetPlants(ctx context.Context, query PlantQuery) ([]Plant, int, error) {
+	log.Printf("Finding Plants in BoltDB with filter %+v, sort %v, limit %v and offset %v\n", query.Filter, query.Sort, query.Limit, query.Offset)
+	plants, err := db.GetAllPlants(ctx)
+	if err != nil {
+		return []Plant{}, 0, err
+	}
+
+	page, total := applyPlantQuery(plants, query)
+	log.Printf("Retrieved Plants from BoltDB. Item count: %v, total: %v\n", len(page), total)
+	return page, total, nil
+}
+
+// StreamPlants calls fn with each Plant matching filter in id order, within
+// a single read transaction so the export is consistent.
+func (db *BoltDb) StreamPlants(ctx context.Context, filter PlantFilter, fn func(plant Plant) error) error {
+	log.Printf("Streaming Plants from BoltDB with filter %+v\n", filter)
+	count := 0
+	var fnErr error
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(plantsBucket).ForEach(func(_, value []byte) error {
+			var plant Plant
+			if err := json.Unmarshal(value, &plant); err != nil {
+				return errors.Wrap(err, "JSON to Plant conversion failed")
+			}
+			if plant.DeletedAt != nil || !filter.Matches(plant) {
+				return nil
+			}
+			if fnErr = ctx.Err(); fnErr != nil {
+				return fnErr
+			}
+			count++
+			fnErr = fn(plant)
+			return fnErr
+		})
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	if err != nil {
+		return errors.Wrap(err, "BoltDB view failed")
+	}
+
+	log.Println("Streamed Plants from BoltDB. Item count: ", count)
+	return nil
+}
+
+func (db *BoltDb) GetPlantById(ctx context.Context, id int) (Plant, error) {
+	log.Printf("Finding Plant in BoltDB with id %v...\n", id)
+	var plant Plant
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		var err error
+		if plant, err = getBoltPlant(tx, id); err == nil && plant.DeletedAt != nil {
+			return &NotFoundError{}
+		}
+		return err
+	})
+	if err != nil {
+		if errors.Is(err, &NotFoundError{}) {
+			return Plant{}, err
+		}
+		return Plant{}, errors.Wrap(err, "BoltDB view failed")
+	}
+
+	log.Printf("Retrieved Plant from BoltDB with id %v. Result: %v\n", id, plant.PrettyString())
+	return plant, nil
+}
+
+func (db *BoltDb) SearchPlants(ctx context.Context, text string, limit int) ([]PlantSearchResult, error) {
+	log.Printf("Searching Plants in BoltDB for '%v'\n", text)
+	plants, err := db.GetAllPlants(ctx)
+	if err != nil {
+		return []PlantSearchResult{}, err
+	}
+
+	results := searchPlants(plants, text, limit)
+	log.Println("Searched Plants in BoltDB. Item count: ", len(results))
+	return results, nil
+}
+
+func (db *BoltDb) CreatePlant(ctx context.Context, plant Plant, opts WriteOptions) error {
+	log.Printf("Inserting new Plant into BoltDB: %v\n", plant.PrettyString())
+	var id int
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		var err error
+		id, err = createBoltPlant(tx, plant, opts)
+		return err
+	})
+	if err != nil {
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) {
+			return err
+		}
+		return errors.Wrap(err, "BoltDB update failed")
+	}
+
+	log.Println("Inserted Plant into BoltDB. id: ", id)
+	return nil
+}
+
+func (db *BoltDb) UpsertPlant(ctx context.Context, id int, plant Plant, opts WriteOptions) (int, error) {
+	log.Printf("Upserting Plant with id %v into BoltDB: %v\n", id, plant.PrettyString())
+	var stored Plant
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		if _, err := upsertBoltPlant(tx, id, plant, opts); err != nil {
+			return err
+		}
+		var err error
+		stored, err = getBoltPlant(tx, id)
+		return err
+	})
+	if err != nil {
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) || errors.Is(err, &PreconditionFailedError{}) {
+			return 0, err
+		}
+		return 0, errors.Wrap(err, "BoltDB update failed")
+	}
+
+	log.Printf("Upserted Plant into BoltDB with id %v\n", id)
+	return stored.Version, nil
+}
+
+func (db *BoltDb) WritePlants(ctx context.Context, writes []PlantWrite, allOrNothing bool, opts WriteOptions) ([]PlantWriteResult, error) {
+	log.Printf("Writing batch of %v Plants into BoltDB\n", len(writes))
+	results := make([]PlantWriteResult, len(writes))
+	rolledBack := false
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		for i, write := range writes {
+			var err error
+			if write.Id == 0 {
+				results[i].Id, err = createBoltPlant(tx, write.Plant, opts)
+				results[i].Created = err == nil
+			} else {
+				results[i].Id = write.Id
+				results[i].Created, err = upsertBoltPlant(tx, write.Id, write.Plant, opts)
+			}
+
+			// Conflicts are found before anything is written, so only they
+			// can be skipped without undoing the whole transaction
+			var conflictErr *ConflictError
+			if err != nil && !errors.As(err, &conflictErr) {
+				return err
+			}
+			results[i].Err = err
+		}
+		if allOrNothing && rollBackFailedBatch(results) {
+			rolledBack = true
+			return &RolledBackError{}
+		}
+		return nil
+	})
+	if err != nil && !rolledBack {
+		return []PlantWriteResult{}, errors.Wrap(err, "BoltDB update failed")
+	}
+
+	log.Printf("Wrote batch into BoltDB. Rolled back: %v\n", rolledBack)
+	return results, nil
+}
+
+// createBoltPlant inserts plant with the next id and returns the id.
+func createBoltPlant(tx *bolt.Tx, plant Plant, opts WriteOptions) (int, error) {
+	if nameTakenInBolt(tx, plant.Name, 0) {
+		return 0, &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
+	}
+
+	// The sequence is incremented within the transaction, so ids are never reused
+	newId, err := tx.Bucket(plantsBucket).NextSequence()
+	if err != nil {
+		return 0, errors.Wrap(err, "BoltDB next sequence failed")
+	}
+	plant.Id = int(newId)
+	plant.Version = 1
+	if err := putBoltPlant(tx, plant, ""); err != nil {
+		return 0, err
+	}
+	return plant.Id, putBoltRevision(tx, newRevision(RevisionActionCreate, nil, plant, opts))
+}
+
+// upsertBoltPlant stores plant under id and reports whether it was new.
+func upsertBoltPlant(tx *bolt.Tx, id int, plant Plant, opts WriteOptions) (bool, error) {
+	existing, err := getBoltPlant(tx, id)
+	if err != nil && !errors.Is(err, &NotFoundError{}) {
+		return false, err
+	}
+	exists := err == nil && existing.DeletedAt == nil
+	if err := checkVersion(existing, exists, opts); err != nil {
+		return false, err
+	}
+	if nameTakenInBolt(tx, plant.Name, id) {
+		return false, &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
+	}
+
+	// Upserting a deleted Plant replaces and restores it. Its name was
+	// already released when it was deleted.
+	previousName := ""
+	if exists {
+		previousName = existing.Name
+	}
+
+	// Keep the sequence ahead of explicitly chosen ids
+	bucket := tx.Bucket(plantsBucket)
+	if id > 0 && uint64(id) > bucket.Sequence() {
+		if err := bucket.SetSequence(uint64(id)); err != nil {
+			return false, errors.Wrap(err, "BoltDB set sequence failed")
+		}
+	}
+
+	plant.Id = id
+	plant.Version = existing.Version + 1
+	plant.DeletedAt = nil
+	if err := putBoltPlant(tx, plant, previousName); err != nil {
+		return false, err
+	}
+	if existing.Id == 0 {
+		return true, putBoltRevision(tx, newRevision(RevisionActionCreate, nil, plant, opts))
+	}
+	return false, putBoltRevision(tx, newRevision(RevisionActionUpdate, &existing, plant, opts))
+}
+
+func (db *BoltDb) PatchPlant(ctx context.Context, id int, changes map[string]interface{}, opts WriteOptions) (int, error) {
+	log.Printf("Patching Plant with id %v in BoltDB: %v\n", id, changes)
+	version := 0
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		existing, err := getBoltPlant(tx, id)
+		if err != nil && !errors.Is(err, &NotFoundError{}) {
+			return err
+		}
+		exists := err == nil && existing.DeletedAt == nil
+		if err := checkVersion(existing, exists, opts); err != nil {
+			return err
+		}
+		if !exists {
+			return &NotFoundError{}
+		}
+		plant, err := applyPlantChanges(existing, changes)
+		if err != nil {
+			return err
+		}
+		if nameTakenInBolt(tx, plant.Name, id) {
+			return &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
+		}
+		plant.Version = existing.Version + 1
+		version = plant.Version
+		if err := putBoltPlant(tx, plant, existing.Name); err != nil {
+			return err
+		}
+		return putBoltRevision(tx, newRevision(RevisionActionUpdate, &existing, plant, opts))
+	})
+	if err != nil {
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) || errors.Is(err, &NotFoundError{}) || errors.Is(err, &PreconditionFailedError{}) {
+			return 0, err
+		}
+		return 0, errors.Wrap(err, "BoltDB update failed")
+	}
+
+	log.Printf("Patched Plant in BoltDB with id %v\n", id)
+	return version, nil
+}
+
+func (db *BoltDb) DeletePlant(ctx context.Context, id int, opts WriteOptions) error {
+	log.Printf("Deleting Plant with id %v in BoltDB\n", id)
+	deletedCount := 0
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		existing, err := getBoltPlant(tx, id)
+		if err != nil && !errors.Is(err, &NotFoundError{}) {
+			return err
+		}
+		exists := err == nil && existing.DeletedAt == nil
+		if err := checkVersion(existing, exists, opts); err != nil || !exists {
+			return err
+		}
+
+		// Deleted Plants are kept, so they can be restored, but release their names
+		if err := tx.Bucket(plantNamesBucket).Delete([]byte(existing.Name)); err != nil {
+			return err
+		}
+		deleted := existing
+		deletedAt := time.Now().UTC()
+		deleted.DeletedAt = &deletedAt
+		deleted.Version++
+		deletedCount = 1
+		if err := storeBoltPlant(tx, deleted); err != nil {
+			return err
+		}
+		return putBoltRevision(tx, newRevision(RevisionActionDelete, &existing, deleted, opts))
+	})
+	if err != nil {
+		if errors.Is(err, &PreconditionFailedError{}) {
+			return err
+		}
+		return errors.Wrap(err, "BoltDB update failed")
+	}
+
+	log.Printf("Deleted Plant in BoltDB. DeletedCount: %v\n", deletedCount)
+	return nil
+}
+
+func (db *BoltDb) RestorePlant(ctx context.Context, id int, opts WriteOptions) (int, error) {
+	log.Printf("Restoring Plant with id %v in BoltDB\n", id)
+	version := 0
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		existing, err := getBoltPlant(tx, id)
+		if err != nil {
+			return err
+		}
+		if existing.DeletedAt == nil {
+			return &NotFoundError{}
+		}
+		if nameTakenInBolt(tx, existing.Name, id) {
+			return &ConflictError{ConflictingKey: "name", ConflictingValue: existing.Name}
+		}
+		plant := existing
+		plant.DeletedAt = nil
+		plant.Version++
+		version = plant.Version
+		if err := putBoltPlant(tx, plant, ""); err != nil {
+			return err
+		}
+		return putBoltRevision(tx, newRevision(RevisionActionRestore, &existing, plant, opts))
+	})
+	if err != nil {
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) || errors.Is(err, &NotFoundError{}) {
+			return 0, err
+		}
+		return 0, errors.Wrap(err, "BoltDB update failed")
+	}
+
+	log.Printf("Restored Plant in BoltDB with id %v\n", id)
+	return version, nil
+}
+
+func (db *BoltDb) PurgePlant(ctx context.Context, id int) error {
+	log.Printf("Purging Plant with id %v in BoltDB\n", id)
+	err := db.update(ctx, func(tx *bolt.Tx) error {
+		plant, err := getBoltPlant(tx, id)
+		if err != nil {
+			return err
+		}
+		if plant.DeletedAt == nil {
+			return &NotFoundError{}
+		}
+
+		// Purging is permanent, so the history goes too. Keys are collected
+		// first as deleting under a cursor can skip entries.
+		revisions := tx.Bucket(plantRevisionsBucket)
+		revisionKeys := make([][]byte, 0)
+		cursor := revisions.Cursor()
+		prefix := boltKey(id)
+		for key, _ := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, _ = cursor.Next() {
+			revisionKeys = append(revisionKeys, append([]byte{}, key...))
+		}
+		for _, key := range revisionKeys {
+			if err := revisions.Delete(key); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(plantsBucket).Delete(boltKey(id))
+	})
+	if err != nil {
+		if errors.Is(err, &NotFoundError{}) {
+			return err
+		}
+		return errors.Wrap(err, "BoltDB update failed")
+	}
+
+	log.Printf("Purged Plant in BoltDB with id %v\n", id)
+	return nil
+}
+
+func (db *BoltDb) GetPlantHistory(ctx context.Context, id int) ([]PlantRevision, error) {
+	log.Printf("Finding history of Plant with id %v in BoltDB\n", id)
+	revisions := make([]PlantRevision, 0)
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(plantRevisionsBucket).Cursor()
+		prefix := boltKey(id)
+		for key, value := cursor.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, value = cursor.Next() {
+			var revision PlantRevision
+			if err := json.Unmarshal(value, &revision); err != nil {
+				return errors.Wrap(err, "JSON to PlantRevision conversion failed")
+			}
+			revisions = append(revisions, revision)
+		}
+		return nil
+	})
+	if err != nil {
+		return []PlantRevision{}, errors.Wrap(err, "BoltDB view failed")
+	}
+
+	log.Println("Retrieved history from BoltDB. Item count: ", len(revisions))
+	return revisions, nil
+}
+
+func (db *BoltDb) GetPlantRevision(ctx context.Context, id int, revision int) (PlantRevision, error) {
+	log.Printf("Finding revision %v of Plant with id %v in BoltDB\n", revision, id)
+	var result PlantRevision
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		value := tx.Bucket(plantRevisionsBucket).Get(boltRevisionKey(id, revision))
+		if value == nil {
+			return &NotFoundError{}
+		}
+		if err := json.Unmarshal(value, &result); err != nil {
+			return errors.Wrap(err, "JSON to PlantRevision conversion failed")
+		}
+		return nil
+	})
+	if err != nil {
+		if errors.Is(err, &NotFoundError{}) {
+			return PlantRevision{}, err
+		}
+		return PlantRevision{}, errors.Wrap(err, "BoltDB view failed")
+	}
+	return result, nil
+}
+
+// plantsWhere returns the stored Plants matching include, in id order.
+func (db *BoltDb) plantsWhere(ctx context.Context, include func(plant Plant) bool) ([]Plant, error) {
+	plants := make([]Plant, 0)
+	err := db.view(ctx, func(tx *bolt.Tx) error {
+		return tx.Bucket(plantsBucket).ForEach(func(_, value []byte) error {
+			var plant Plant
+			if err := json.Unmarshal(value, &plant); err != nil {
+				return errors.Wrap(err, "JSON to Plant conversion failed")
+			}
+			if include(plant) {
+				plants = append(plants, plant)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return []Plant{}, errors.Wrap(err, "BoltDB view failed")
+	}
+	return plants, nil
+}
+
+func getBoltPlant(tx *bolt.Tx, id int) (Plant, error) {
+	value := tx.Bucket(plantsBucket).Get(boltKey(id))
+	if value == nil {
+		return Plant{}, &NotFoundError{}
+	}
+	var plant Plant
+	if err := json.Unmarshal(value, &plant); err != nil {
+		return Plant{}, errors.Wrap(err, "JSON to Plant conversion failed")
+	}
+	return plant, nil
+}
+
+// putBoltPlant stores plant and moves its entry in the name index from
+// previousName, if the plant was previously stored under another name.
+func putBoltPlant(tx *bolt.Tx, plant Plant, previousName string) error {
+	names := tx.Bucket(plantNamesBucket)
+	if previousName != "" && previousName != plant.Name {
+		if err := names.Delete([]byte(previousName)); err != nil {
+			return err
+		}
+	}
+	if err := names.Put([]byte(plant.Name), boltKey(plant.Id)); err != nil {
+		return err
+	}
+	return storeBoltPlant(tx, plant)
+}
+
+// storeBoltPlant stores plant without updating the name index.
+func storeBoltPlant(tx *bolt.Tx, plant Plant) error {
+	value, err := json.Marshal(plant)
+	if err != nil {
+		return errors.Wrap(err, "Plant to JSON conversion failed")
+	}
+	return tx.Bucket(plantsBucket).Put(boltKey(plant.Id), value)
+}
+
+// putBoltRevision records a write in the history of its Plant.
+func putBoltRevision(tx *bolt.Tx, revision PlantRevision) error {
+	value, err := json.Marshal(revision)
+	if err != nil {
+		return errors.Wrap(err, "PlantRevision to JSON conversion failed")
+	}
+	return tx.Bucket(plantRevisionsBucket).Put(boltRevisionKey(revision.PlantId, revision.Revision), value)
+}
+
+func nameTakenInBolt(tx *bolt.Tx, name string, id int) bool {
+	existingId := tx.Bucket(plantNamesBucket).Get([]byte(name))
+	return existingId != nil && int(binary.BigEndian.Uint64(existingId)) != id
+}
+
+// boltKey encodes an id big-endian so keys iterate in id order.
+func boltKey(id int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// boltRevisionKey prefixes the revision number with the Plant's id, so each
+// Plant's history is stored together and in order.
+func boltRevisionKey(id int, revision int) []byte {
+	return append(boltKey(id), boltKey(revision)...)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"gopkg.in/yaml.v2"
+)
+
+// codec reads and writes request and response bodies in one media type.
+// The first of its media types is the one responses are labelled with.
+type codec struct {
+	mediaTypes         []string
+	problemContentType string
+	encode             func(w io.Writer, v interface{}) error
+	decode             func(r io.Reader, v interface{}) error
+}
+
+var (
+	jsonCodec = codec{
+		mediaTypes:         []string{"application/json", problemContentType},
+		problemContentType: problemContentType,
+		encode:             func(w io.Writer, v interface{}) error { return json.NewEncoder(w).Encode(v) },
+		decode:             decodeJson,
+	}
+	xmlCodec = codec{
+		mediaTypes:         []string{"application/xml", "text/xml", "application/problem+xml"},
+		problemContentType: "application/problem+xml",
+		encode:             encodeXml,
+		decode:             decodeXml,
+	}
+	yamlCodec = codec{
+		mediaTypes:         []string{"application/yaml", "application/x-yaml", "text/yaml"},
+		problemContentType: "application/yaml",
+		encode:             func(w io.Writer, v interface{}) error { return yaml.NewEncoder(w).Encode(v) },
+		decode:             decodeYaml,
+	}
+	msgpackCodec = codec{
+		mediaTypes:         []string{"application/msgpack", "application/x-msgpack", "application/vnd.msgpack"},
+		problemContentType: "application/msgpack",
+		encode:             encodeMsgpack,
+		decode:             decodeMsgpack,
+	}
+)
+
+// codecs are in order of preference, for when the Accept header allows
+// several equally. JSON comes first as the default.
+var codecs = []codec{jsonCodec, xmlCodec, yamlCodec, msgpackCodec}
+
+// responseCodec picks the codec the Accept header of the request prefers,
+// returning false if it accepts none of them. Each codec gets the quality of
+// the most specific media range matching it, and ties go to the codec
+// earliest in codecs. Requests without an Accept header get JSON.
+func responseCodec(r *http.Request) (codec, bool) {
+	accept := r.Header.Get("accept")
+	if strings.TrimSpace(accept) == "" {
+		return jsonCodec, true
+	}
+
+	best, bestQuality := jsonCodec, 0.0
+	for _, c := range codecs {
+		quality, specificity := 0.0, -1
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(mediaRange)
+			if err != nil {
+				continue
+			}
+			rangeSpecificity := c.matches(mediaType)
+			if rangeSpecificity <= specificity {
+				continue
+			}
+			rangeQuality := 1.0
+			if q, ok := params["q"]; ok {
+				if rangeQuality, err = strconv.ParseFloat(q, 64); err != nil {
+					continue
+				}
+			}
+			quality, specificity = rangeQuality, rangeSpecificity
+		}
+		if quality > bestQuality {
+			best, bestQuality = c, quality
+		}
+	}
+	return best, bestQuality > 0
+}
+
+// requestCodec picks the codec for the content type of the request body,
+// returning false if it isn't supported. Bodies without a content type are
+// read as JSON.
+func requestCodec(r *http.Request) (codec, bool) {
+	contentType := r.Header.Get("content-type")
+	if contentType == "" {
+		return jsonCodec, true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return codec{}, false
+	}
+	for _, c := range codecs {
+		for _, candidate := range c.mediaTypes {
+			if mediaType == candidate {
+				return c, true
+			}
+		}
+	}
+	return codec{}, false
+}
+
+// matches returns how specifically mediaRange, which may have wildcards,
+// includes one of the media types of the codec: 2 for an exact match, 1 for
+// a subtype wildcard, 0 for */* and -1 if it doesn't.
+func (c codec) matches(mediaRange string) int {
+	specificity := -1
+	if mediaRange == "*/*" {
+		specificity = 0
+	}
+	for _, mediaType := range c.mediaTypes {
+		if mediaType == mediaRange {
+			return 2
+		}
+		if strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")) {
+			specificity = 1
+		}
+	}
+	return specificity
+}
+
+func (c codec) contentType() string {
+	return c.mediaTypes[0]
+}
+
+func supportedMediaTypes() string {
+	mediaTypes := make([]string, 0, len(codecs))
+	for _, c := range codecs {
+		mediaTypes = append(mediaTypes, c.contentType())
+	}
+	return strings.Join(mediaTypes, ", ")
+}
+
+// Decoding is strict, so that fields a client misspells are reported
+// rather than silently ignored.
+func decodeJson(r io.Reader, v interface{}) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func decodeYaml(r io.Reader, v interface{}) error {
+	decoder := yaml.NewDecoder(r)
+	decoder.SetStrict(true)
+	return decoder.Decode(v)
+}
+
+// The msgpack codec uses the JSON field names, so that the two formats have
+// the same shape.
+func encodeMsgpack(w io.Writer, v interface{}) error {
+	encoder := msgpack.NewEncoder(w)
+	encoder.SetCustomStructTag("json")
+	return encoder.Encode(v)
+}
+
+func decodeMsgpack(r io.Reader, v interface{}) error {
+	decoder := msgpack.NewDecoder(r)
+	decoder.SetCustomStructTag("json")
+	decoder.DisallowUnknownFields(true)
+	return decoder.Decode(v)
+}
+
+// encodeXml writes v as an XML document. XML has no arrays or maps, so a
+// slice is written as an element named after its items holding one element
+// per item, and a map as an element holding one element per key.
+func encodeXml(w io.Writer, v interface{}) error {
+	encoder := xml.NewEncoder(w)
+	value := reflect.Indirect(reflect.ValueOf(v))
+	switch value.Kind() {
+	case reflect.Slice:
+		itemName := xmlElementName(value.Type().Elem())
+		root := xml.StartElement{Name: xml.Name{Space: itemName.Space, Local: itemName.Local + "s"}}
+		if err := encoder.EncodeToken(root); err != nil {
+			return err
+		}
+		for i := 0; i < value.Len(); i++ {
+			if err := encoder.EncodeElement(value.Index(i).Interface(), xml.StartElement{Name: itemName}); err != nil {
+				return err
+			}
+		}
+		if err := encoder.EncodeToken(root.End()); err != nil {
+			return err
+		}
+	case reflect.Map:
+		keys := make([]string, 0, value.Len())
+		for _, key := range value.MapKeys() {
+			keys = append(keys, fmt.Sprint(key.Interface()))
+		}
+		sort.Strings(keys)
+		root := xml.StartElement{Name: xml.Name{Local: "response"}}
+		if err := encoder.EncodeToken(root); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := encoder.EncodeElement(value.MapIndex(reflect.ValueOf(key)).Interface(), xml.StartElement{Name: xml.Name{Local: key}}); err != nil {
+				return err
+			}
+		}
+		if err := encoder.EncodeToken(root.End()); err != nil {
+			return err
+		}
+	default:
+		if err := encoder.EncodeElement(v, xml.StartElement{Name: xmlElementName(value.Type())}); err != nil {
+			return err
+		}
+	}
+	if err := encoder.Flush(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// decodeXml reads what encodeXml writes. Slices are read from the children
+// of the root element, whatever their names.
+func decodeXml(r io.Reader, v interface{}) error {
+	decoder := xml.NewDecoder(r)
+	slice := reflect.ValueOf(v).Elem()
+	if slice.Kind() != reflect.Slice {
+		return decoder.Decode(v)
+	}
+
+	inRoot := false
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			if !inRoot {
+				inRoot = true
+				continue
+			}
+			item := reflect.New(slice.Type().Elem())
+			if err := decoder.DecodeElement(item.Interface(), &element); err != nil {
+				return err
+			}
+			slice.Set(reflect.Append(slice, item.Elem()))
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// xmlRootNames overrides the element names of types with a standard XML
+// form, such as RFC 7807 problem details.
+var xmlRootNames = map[reflect.Type]xml.Name{
+	reflect.TypeOf(ErrorResponse{}): {Space: "urn:ietf:rfc:7807", Local: "problem"},
+}
+
+// xmlElementName names the element for a value of type t after the type,
+// so a Plant is written as <plant>.
+func xmlElementName(t reflect.Type) xml.Name {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if name, ok := xmlRootNames[t]; ok {
+		return name
+	}
+	if t.Name() == "" {
+		return xml.Name{Local: "item"}
+	}
+	return xml.Name{Local: strings.ToLower(t.Name()[:1]) + t.Name()[1:]}
+}
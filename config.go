@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// Every config key can be overridden by an environment variable named after
+// it with this prefix, such as PLANT_API_SERVER_ADDRESS for Server.Address.
+const configEnvPrefix = "PLANT_API"
+
+type configSetting struct {
+	key          string
+	defaultValue interface{}
+	usage        string
+}
+
+// configSettings lists every config key with its default, which applies when
+// the config file leaves the key out.
+var configSettings = []configSetting{
+	{"Server.Address", ":8081", "address to listen on"},
+	{"Server.ReadTimeout", 30 * time.Second, "longest time to read a request, including its body"},
+	{"Server.WriteTimeout", 10 * time.Minute, "longest time to write a response, which must cover exports"},
+	{"Server.IdleTimeout", 2 * time.Minute, "longest time to keep an idle connection open"},
+	{"Server.MaxHeaderBytes", http.DefaultMaxHeaderBytes, "largest request header accepted, in bytes"},
+	{"Server.MaxBodyBytes", 10 << 20, "largest request body accepted, in bytes, or 0 for no limit"},
+	{"Server.Tls.CertFile", "", "certificate file to serve HTTPS with, along with the key file"},
+	{"Server.Tls.KeyFile", "", "private key file to serve HTTPS with, along with the certificate file"},
+	{"Server.ShutdownDelay", time.Duration(0), "time to keep serving after reporting not ready on shutdown"},
+	{"Server.DrainTimeout", 30 * time.Second, "longest time to wait for requests in flight on shutdown"},
+	{"Database.Type", "mongodb", "database to store Plants in: mongodb, bolt or memory"},
+	{"Database.Timeouts.Connect", 10 * time.Second, "deadline for connecting to and disconnecting from the database"},
+	{"Database.Timeouts.Read", 5 * time.Second, "deadline for the database reads of a request"},
+	{"Database.Timeouts.Write", 10 * time.Second, "deadline for the database writes of a request"},
+	{"Database.Timeouts.Batch", 30 * time.Second, "deadline for batch writes and imports"},
+	{"Database.Timeouts.Export", 5 * time.Minute, "deadline for exports"},
+	{"Database.Timeouts.Warnings", time.Second, "deadline for the lookups behind warnings, which are skipped when it passes"},
+	{"MongoDb.DbUrl", "mongodb://127.0.0.1:27017/?maxPoolSize=20&w=majority", "MongoDB connection string"},
+	{"MongoDb.DbName", "plantsdb", "MongoDB database name"},
+	{"MongoDb.CollectionName", "plants", "MongoDB collection of Plants"},
+	{"BoltDb.Path", "./data/plants.db", "BoltDB file path"},
+	{"Admin.ApiKey", "", "key required in the X-Admin-Key header of admin-only requests"},
+	{"OpenApi.DocsUi", false, "serve Swagger UI at /docs"},
+}
+
+// addConfigFlags adds --config and a flag overriding each config key to
+// flags. The flags are named after the keys in lower case, such as
+// --server.address.
+func addConfigFlags(flags *flag.FlagSet) {
+	flags.String("config", os.Getenv(configEnvPrefix+"_CONFIG"), "path of the config file (default ./config/config.yml)")
+	for _, setting := range configSettings {
+		flags.String(strings.ToLower(setting.key), fmt.Sprint(setting.defaultValue), setting.usage)
+	}
+}
+
+// loadConfig reads the config file, then applies the environment variables
+// and the flags which were set, which take precedence in that order.
+func loadConfig(flags *flag.FlagSet) {
+	for _, setting := range configSettings {
+		viper.SetDefault(setting.key, setting.defaultValue)
+	}
+
+	configPath := flags.Lookup("config").Value.String()
+	if configPath != "" {
+		viper.SetConfigFile(configPath)
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath("./config/")
+	}
+	// Without a config file the defaults, environment and flags still apply,
+	// but a file which was asked for must be there
+	var notFoundErr viper.ConfigFileNotFoundError
+	if err := viper.ReadInConfig(); err != nil && (configPath != "" || !errors.As(err, &notFoundErr)) {
+		log.Println("Error while loading config from file: ", err)
+		os.Exit(1)
+	} else if err != nil {
+		log.Println("No config file found, so using defaults and the environment")
+	} else {
+		log.Printf("Loaded config from %v\n", viper.ConfigFileUsed())
+	}
+
+	viper.SetEnvPrefix(configEnvPrefix)
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	viper.AutomaticEnv()
+
+	// Flags go through Set, which takes precedence over everything else
+	flags.Visit(func(f *flag.Flag) {
+		for _, setting := range configSettings {
+			if f.Name == strings.ToLower(setting.key) {
+				viper.Set(setting.key, f.Value.String())
+			}
+		}
+	})
+}
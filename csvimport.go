@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	importStatusCreated = "created"
+	importStatusUpdated = "updated"
+	importStatusSkipped = "skipped"
+	importStatusFailed  = "failed"
+
+	csvContentType             = "text/csv"
+	defaultOtherNamesDelimiter = ";"
+)
+
+type ImportOptions struct {
+	// DryRun reports what the import would do without writing anything.
+	DryRun bool
+	// OtherNamesDelimiter separates the names in the otherNames column.
+	OtherNamesDelimiter string
+	Actor               string
+}
+
+// ImportError is returned when a CSV file can't be imported at all, as
+// opposed to individual rows failing.
+type ImportError struct {
+	Message string
+}
+
+func (err *ImportError) Error() string {
+	return err.Message
+}
+
+// importPlantsCsv creates or updates a Plant for each row of a CSV file. The
+// header row names the Plant field of each column, by its JSON name. Rows
+// with an id update that Plant, other rows update the Plant with the same
+// name or create a new one. Rows which wouldn't change anything are skipped.
+func importPlantsCsv(ctx context.Context, db Database, reader io.Reader, opts ImportOptions) (ImportReport, error) {
+	log.Printf("Importing Plants from CSV. Dry run: %v\n", opts.DryRun)
+	if opts.OtherNamesDelimiter == "" {
+		opts.OtherNamesDelimiter = defaultOtherNamesDelimiter
+	}
+
+	csvReader := csv.NewReader(reader)
+	csvReader.TrimLeadingSpace = true
+	header, err := csvReader.Read()
+	if err != nil {
+		return ImportReport{}, &ImportError{Message: "The CSV must start with a header row"}
+	}
+	columns, err := readImportHeader(header)
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	existing, err := db.GetAllPlants(ctx)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	existingById := make(map[int]Plant)
+	existingByName := make(map[string]Plant)
+	for _, plant := range existing {
+		existingById[plant.Id] = plant
+		existingByName[plant.Name] = plant
+	}
+
+	// Work out what to do with each row before writing anything
+	report := ImportReport{DryRun: opts.DryRun, Rows: make([]ImportRowResult, 0)}
+	writes := make([]PlantWrite, 0)
+	writeRows := make([]int, 0)
+	rowsByName := make(map[string]int)
+	for rowNumber := 2; ; rowNumber++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				return ImportReport{}, &ImportError{Message: fmt.Sprintf("Row %v of the CSV could not be parsed", rowNumber)}
+			}
+			return ImportReport{}, errors.Wrap(err, "CSV read failed")
+		}
+
+		row := ImportRowResult{Row: rowNumber}
+		id, plantRequest, fieldErrors := readImportRow(record, columns, opts.OtherNamesDelimiter)
+		row.Id, row.Name = id, plantRequest.Name
+		if len(fieldErrors) == 0 {
+			fieldErrors = plantRequest.Validate()
+		}
+		if previousRow, ok := rowsByName[plantRequest.Name]; ok && plantRequest.Name != "" {
+			fieldErrors = append(fieldErrors, FieldError{
+				Field:   "name",
+				Code:    fieldErrorDuplicate,
+				Message: fmt.Sprintf("The name is already used by row %v", previousRow),
+			})
+		}
+		if len(fieldErrors) > 0 {
+			row.Status = importStatusFailed
+			row.Errors = fieldErrors
+			report.Rows = append(report.Rows, row)
+			continue
+		}
+		rowsByName[plantRequest.Name] = rowNumber
+
+		plant := Plant{
+			Name:       plantRequest.Name,
+			OtherNames: plantRequest.OtherNames,
+			Light:      plantRequest.Light,
+			Humidity:   plantRequest.Humidity,
+			Water:      plantRequest.Water,
+		}
+		current, exists := existingById[id]
+		if id == 0 {
+			current, exists = existingByName[plant.Name]
+		}
+		switch {
+		case exists && plantContentEqual(current, plant):
+			row.Id = current.Id
+			row.Status = importStatusSkipped
+		case exists:
+			row.Id = current.Id
+			row.Status = importStatusUpdated
+		default:
+			row.Status = importStatusCreated
+		}
+		if row.Status != importStatusSkipped {
+			writes = append(writes, PlantWrite{Id: row.Id, Plant: plant})
+			writeRows = append(writeRows, len(report.Rows))
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	if !opts.DryRun && len(writes) > 0 {
+		results, err := db.WritePlants(ctx, writes, false, WriteOptions{Actor: opts.Actor})
+		if err != nil {
+			return ImportReport{}, err
+		}
+		for i, result := range results {
+			row := &report.Rows[writeRows[i]]
+			var conflictErr *ConflictError
+			switch {
+			case result.Err == nil:
+				row.Id = result.Id
+				if result.Created {
+					row.Status = importStatusCreated
+				} else {
+					row.Status = importStatusUpdated
+				}
+			case errors.As(result.Err, &conflictErr):
+				row.Status = importStatusFailed
+				row.Errors = []FieldError{{
+					Field:   conflictErr.ConflictingKey,
+					Code:    fieldErrorDuplicate,
+					Message: fmt.Sprintf("Plant with %v '%v' already exists", conflictErr.ConflictingKey, conflictErr.ConflictingValue),
+				}}
+			default:
+				return ImportReport{}, result.Err
+			}
+		}
+	}
+
+	for _, row := range report.Rows {
+		switch row.Status {
+		case importStatusCreated:
+			report.Created++
+		case importStatusUpdated:
+			report.Updated++
+		case importStatusSkipped:
+			report.Skipped++
+		case importStatusFailed:
+			report.Failed++
+		}
+	}
+	log.Printf("Imported Plants from CSV. Created: %v, updated: %v, skipped: %v, failed: %v\n",
+		report.Created, report.Updated, report.Skipped, report.Failed)
+	return report, nil
+}
+
+// readImportHeader maps each Plant field to its column, matching the JSON
+// names of the fields case-insensitively.
+func readImportHeader(header []string) (map[string]int, error) {
+	fields := []string{"id", "name", "otherNames", "light", "humidity", "water"}
+	columns := make(map[string]int)
+	for i, column := range header {
+		field := ""
+		for _, candidate := range fields {
+			if strings.EqualFold(strings.TrimSpace(column), candidate) {
+				field = candidate
+			}
+		}
+		if field == "" {
+			return nil, &ImportError{Message: fmt.Sprintf("The CSV column '%v' is not a Plant field", column)}
+		}
+		if _, ok := columns[field]; ok {
+			return nil, &ImportError{Message: fmt.Sprintf("The CSV column '%v' appears more than once", column)}
+		}
+		columns[field] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, &ImportError{Message: "The CSV must have a name column"}
+	}
+	return columns, nil
+}
+
+func readImportRow(record []string, columns map[string]int, otherNamesDelimiter string) (int, PlantRequest, []FieldError) {
+	value := func(field string) string {
+		if i, ok := columns[field]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	plantRequest := PlantRequest{
+		Name:       value("name"),
+		OtherNames: []string{},
+		Light:      LightLevel(canonicalLevel(value("light"), lightVocabulary)),
+		Humidity:   HumidityLevel(canonicalLevel(value("humidity"), humidityVocabulary)),
+		Water:      WaterLevel(canonicalLevel(value("water"), waterVocabulary)),
+	}
+	for _, otherName := range strings.Split(value("otherNames"), otherNamesDelimiter) {
+		if otherName = strings.TrimSpace(otherName); otherName != "" {
+			plantRequest.OtherNames = append(plantRequest.OtherNames, otherName)
+		}
+	}
+
+	id := 0
+	if idStr := value("id"); idStr != "" {
+		var err error
+		if id, err = strconv.Atoi(idStr); err != nil || id < 1 {
+			return 0, plantRequest, []FieldError{{Field: "id", Code: fieldErrorInvalidValue, Message: "The id value must be a positive integer"}}
+		}
+	}
+	return id, plantRequest, nil
+}
+
+// plantContentEqual reports whether two Plants have the same editable
+// fields, treating missing other names as none.
+func plantContentEqual(a Plant, b Plant) bool {
+	if a.Name != b.Name || a.Light != b.Light || a.Humidity != b.Humidity || a.Water != b.Water || len(a.OtherNames) != len(b.OtherNames) {
+		return false
+	}
+	for i := range a.OtherNames {
+		if a.OtherNames[i] != b.OtherNames[i] {
+			return false
+		}
+	}
+	return true
+}
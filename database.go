@@ -2,65 +2,183 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type Database interface {
-	GetAllPlants() ([]Plant, error)
-	GetPlantById(id int) (Plant, error)
-	CreatePlant(plant Plant) error
-	UpsertPlant(id int, plant Plant) error
-	DeletePlant(id int) error
-	Connect() error
-	Disconnect() error
+	GetAllPlants(ctx context.Context) ([]Plant, error)
+	GetPlants(ctx context.Context, query PlantQuery) ([]Plant, int, error)
+	StreamPlants(ctx context.Context, filter PlantFilter, fn func(plant Plant) error) error
+	GetPlantById(ctx context.Context, id int) (Plant, error)
+	SearchPlants(ctx context.Context, text string, limit int) ([]PlantSearchResult, error)
+	CreatePlant(ctx context.Context, plant Plant, opts WriteOptions) error
+	UpsertPlant(ctx context.Context, id int, plant Plant, opts WriteOptions) (int, error)
+	WritePlants(ctx context.Context, writes []PlantWrite, allOrNothing bool, opts WriteOptions) ([]PlantWriteResult, error)
+	PatchPlant(ctx context.Context, id int, changes map[string]interface{}, opts WriteOptions) (int, error)
+	DeletePlant(ctx context.Context, id int, opts WriteOptions) error
+	GetDeletedPlants(ctx context.Context) ([]Plant, error)
+	RestorePlant(ctx context.Context, id int, opts WriteOptions) (int, error)
+	PurgePlant(ctx context.Context, id int) error
+	GetPlantHistory(ctx context.Context, id int) ([]PlantRevision, error)
+	GetPlantRevision(ctx context.Context, id int, revision int) (PlantRevision, error)
+	Connect(ctx context.Context) error
+	Disconnect(ctx context.Context) error
+	Ping(ctx context.Context) error
 }
 
+// Database operations are given the deadline configured for their kind
+// under Database.Timeouts.
+const (
+	dbOperationConnect  = "Connect"
+	dbOperationRead     = "Read"
+	dbOperationWrite    = "Write"
+	dbOperationBatch    = "Batch"
+	dbOperationExport   = "Export"
+	dbOperationWarnings = "Warnings"
+)
+
+// dbContext bounds database operations of the given kind by their deadline,
+// as well as by parent, so that they stop early if a client goes away. A zero
+// timeout means no deadline.
+func dbContext(parent context.Context, operation string) (context.Context, context.CancelFunc) {
+	timeout := viper.GetDuration("Database.Timeouts." + operation)
+	if timeout <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, timeout)
+}
+
+// WriteOptions are preconditions and audit details for a write to a Plant.
+type WriteOptions struct {
+	// IfVersion, when non-zero, makes the write fail with a
+	// PreconditionFailedError unless the stored Plant has this version.
+	IfVersion int
+	// Actor identifies the client making the write in the Plant's history.
+	Actor string
+}
+
+// PlantWrite is one item of a batch write. Plant is created with a new id
+// when Id is 0, otherwise it is upserted with that id.
+type PlantWrite struct {
+	Id    int
+	Plant Plant
+}
+
+// PlantWriteResult is the outcome of the PlantWrite at the same index. Err is
+// a ConflictError or, in all-or-nothing mode, a RolledBackError for writes
+// which were undone because another one failed.
+type PlantWriteResult struct {
+	Id      int
+	Created bool
+	Err     error
+}
+
+// rollBackFailedBatch replaces the results of the successful writes of a
+// failed all-or-nothing batch. It reports whether the batch failed.
+func rollBackFailedBatch(results []PlantWriteResult) bool {
+	failed := false
+	for _, result := range results {
+		failed = failed || result.Err != nil
+	}
+	if failed {
+		for i := range results {
+			if results[i].Err == nil {
+				results[i] = PlantWriteResult{Err: &RolledBackError{}}
+			}
+		}
+	}
+	return failed
+}
+
+// newRevision records a write by opts.Actor which changed a Plant from
+// before, which is nil for a new Plant, to after.
+func newRevision(action string, before *Plant, after Plant, opts WriteOptions) PlantRevision {
+	return PlantRevision{
+		PlantId:   after.Id,
+		Revision:  after.Version,
+		Action:    action,
+		Timestamp: time.Now().UTC(),
+		Actor:     opts.Actor,
+		Before:    before,
+		After:     &after,
+	}
+}
+
+// checkVersion enforces opts for backends which read a Plant before writing
+// it. exists is false when there is no stored Plant.
+func checkVersion(stored Plant, exists bool, opts WriteOptions) error {
+	if opts.IfVersion != 0 && (!exists || stored.Version != opts.IfVersion) {
+		return &PreconditionFailedError{}
+	}
+	return nil
+}
+
+const (
+	countersCollectionName  = "counters"
+	revisionsCollectionName = "plantRevisions"
+	maxIdAllocationAttempts = 5
+)
+
 type MongoDb struct {
 	Driver         *mongo.Client
 	DbName         string
 	CollectionName string
 }
 
-func (db *MongoDb) Connect() error {
+func (db *MongoDb) Connect(ctx context.Context) error {
 	log.Println("Connecting to MongoDB...")
-	dbClient, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(viper.GetString("MongoDb.DbUrl")))
+	dbClient, err := mongo.Connect(ctx, options.Client().ApplyURI(viper.GetString("MongoDb.DbUrl")))
 	if err != nil {
 		return errors.Wrap(err, "MongoDB connect failed")
 	}
 
-	if err := dbClient.Ping(context.TODO(), readpref.Primary()); err != nil {
-		return errors.Wrap(err, "MongoDB ping failed")
-	}
-
 	db.Driver = dbClient
+	if err := db.Ping(ctx); err != nil {
+		return err
+	}
 	log.Println("Connected to MongoDB.")
-	return nil
+
+	// Plants may have been added before the id counter existed
+	return db.syncIdCounter(ctx)
 }
 
-func (db *MongoDb) Disconnect() error {
+func (db *MongoDb) Disconnect(ctx context.Context) error {
 	log.Println("Disconnecting from MongoDB...")
-	if err := db.Driver.Disconnect(context.TODO()); err != nil {
+	if err := db.Driver.Disconnect(ctx); err != nil {
 		return err
 	}
 	log.Println("Disconnected from MongoDB.")
 	return nil
 }
 
-func (db *MongoDb) GetAllPlants() ([]Plant, error) {
+// Ping checks that the primary can be reached, as only it can take writes.
+func (db *MongoDb) Ping(ctx context.Context) error {
+	if err := db.Driver.Ping(ctx, readpref.Primary()); err != nil {
+		return errors.Wrap(err, "MongoDB ping failed")
+	}
+	return nil
+}
+
+func (db *MongoDb) GetAllPlants(ctx context.Context) ([]Plant, error) {
 	// Get plants from DB
 	log.Println("Finding all Plants in MongoDB")
-	filter := bson.D{}
+	filter := bson.D{{Key: "deletedAt", Value: nil}}
 	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
-	cursor, err := collection.Find(context.TODO(), filter)
+	cursor, err := collection.Find(ctx, filter)
 	if err != nil {
-		if errors.As(err, &mongo.ErrNoDocuments) {
+		if errors.Is(err, mongo.ErrNoDocuments) {
 			log.Println("No Plants in database")
 			return []Plant{}, nil
 		}
@@ -69,7 +187,7 @@ func (db *MongoDb) GetAllPlants() ([]Plant, error) {
 
 	// Decode all documents
 	var results []bson.M
-	if err = cursor.All(context.TODO(), &results); err != nil {
+	if err = cursor.All(ctx, &results); err != nil {
 		return []Plant{}, errors.Wrap(err, "MongoDB decode failed")
 	}
 
@@ -87,15 +205,84 @@ func (db *MongoDb) GetAllPlants() ([]Plant, error) {
 	return plants, nil
 }
 
-func (db *MongoDb) GetPlantById(id int) (Plant, error) {
+func (db *MongoDb) GetPlants(ctx context.Context, query PlantQuery) ([]Plant, int, error) {
+	log.Printf("Finding Plants in MongoDB with filter %+v, sort %v, limit %v and offset %v\n", query.Filter, query.Sort, query.Limit, query.Offset)
+	filter := plantFilterToBson(query.Filter)
+	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return []Plant{}, 0, errors.Wrap(err, "MongoDB countDocuments failed")
+	}
+
+	findOptions := options.Find().SetSort(sortFieldsToBson(query.Sort)).SetSkip(int64(query.Offset))
+	if query.Limit > 0 {
+		findOptions.SetLimit(int64(query.Limit))
+	}
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return []Plant{}, 0, errors.Wrap(err, "MongoDB find failed")
+	}
+
+	// Decode all documents in the page
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return []Plant{}, 0, errors.Wrap(err, "MongoDB decode failed")
+	}
+
+	// Parse docs into Plant objects
+	plants := make([]Plant, 0, len(results))
+	for _, result := range results {
+		var plant Plant
+		if err := bsonToPlant(result, &plant); err != nil {
+			return []Plant{}, 0, errors.Wrap(err, "BSON to Plant conversion failed")
+		}
+		plants = append(plants, plant)
+	}
+
+	log.Printf("Retrieved Plants from MongoDB. Item count: %v, total: %v\n", len(plants), total)
+	return plants, int(total), nil
+}
+
+// StreamPlants calls fn with each Plant matching filter in id order, decoding
+// them from the cursor one at a time. It stops at the first error from fn.
+func (db *MongoDb) StreamPlants(ctx context.Context, filter PlantFilter, fn func(plant Plant) error) error {
+	log.Printf("Streaming Plants from MongoDB with filter %+v\n", filter)
+	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	findOptions := options.Find().SetSort(bson.D{{Key: "id", Value: 1}})
+	cursor, err := collection.Find(ctx, plantFilterToBson(filter), findOptions)
+	if err != nil {
+		return errors.Wrap(err, "MongoDB find failed")
+	}
+	defer cursor.Close(ctx)
+
+	count := 0
+	for cursor.Next(ctx) {
+		var plant Plant
+		if err := cursor.Decode(&plant); err != nil {
+			return errors.Wrap(err, "BSON to Plant conversion failed")
+		}
+		if err := fn(plant); err != nil {
+			return err
+		}
+		count++
+	}
+	if err := cursor.Err(); err != nil {
+		return errors.Wrap(err, "MongoDB cursor failed")
+	}
+
+	log.Println("Streamed Plants from MongoDB. Item count: ", count)
+	return nil
+}
+
+func (db *MongoDb) GetPlantById(ctx context.Context, id int) (Plant, error) {
 	// Get plant from DB
 	log.Printf("Finding Plant in MongoDB with id %v...\n", id)
-	filter := bson.D{{Key: "id", Value: id}}
+	filter := bson.D{{Key: "id", Value: id}, {Key: "deletedAt", Value: nil}}
 	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
 	var result bson.D
-	err := collection.FindOne(context.TODO(), filter).Decode(&result)
+	err := collection.FindOne(ctx, filter).Decode(&result)
 	if err != nil {
-		if errors.As(err, &mongo.ErrNoDocuments) {
+		if errors.Is(err, mongo.ErrNoDocuments) {
 			return Plant{}, &NotFoundError{}
 		}
 		return Plant{}, errors.Wrap(err, "MongoDB findOne failed")
@@ -111,75 +298,639 @@ func (db *MongoDb) GetPlantById(id int) (Plant, error) {
 	return plant, nil
 }
 
-func (db *MongoDb) CreatePlant(plant Plant) error {
-	log.Printf("Inserting new Plant into MongoDB: %v\n", plant.PrettyString())
-
-	newId, err := db.generateNewId()
+func (db *MongoDb) SearchPlants(ctx context.Context, text string, limit int) ([]PlantSearchResult, error) {
+	log.Printf("Searching Plants in MongoDB for '%v'\n", text)
+	filter := bson.D{
+		{Key: "$text", Value: bson.D{{Key: "$search", Value: text}}},
+		{Key: "deletedAt", Value: nil},
+	}
+	textScore := bson.D{{Key: "$meta", Value: "textScore"}}
+	findOptions := options.Find().
+		SetProjection(bson.D{{Key: "score", Value: textScore}}).
+		SetSort(bson.D{{Key: "score", Value: textScore}, {Key: "id", Value: 1}})
+	if limit > 0 {
+		findOptions.SetLimit(int64(limit))
+	}
+	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	cursor, err := collection.Find(ctx, filter, findOptions)
 	if err != nil {
-		return err
+		return []PlantSearchResult{}, errors.Wrap(err, "MongoDB find failed")
 	}
-	plant.Id = newId
 
-	// Convert Plant object into BSON doc
-	_, doc, err := bson.MarshalValue(plant)
-	if err != nil {
-		return errors.Wrap(err, "Plant to BSON conversion failed")
+	// Decode all matching documents
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return []PlantSearchResult{}, errors.Wrap(err, "MongoDB decode failed")
 	}
 
-	// Insert plant into DB
+	// Parse docs into Plant objects, keeping their scores
+	searchResults := make([]PlantSearchResult, 0, len(results))
+	for _, result := range results {
+		var searchResult PlantSearchResult
+		if err := bsonToPlant(result, &searchResult.Plant); err != nil {
+			return []PlantSearchResult{}, errors.Wrap(err, "BSON to Plant conversion failed")
+		}
+		searchResult.Score, _ = result["score"].(float64)
+		searchResults = append(searchResults, searchResult)
+	}
+
+	log.Println("Searched Plants in MongoDB. Item count: ", len(searchResults))
+	return searchResults, nil
+}
+
+func (db *MongoDb) CreatePlant(ctx context.Context, plant Plant, opts WriteOptions) error {
+	_, err := db.insertPlant(ctx, plant, opts)
+	return err
+}
+
+// insertPlant inserts plant with a new id from the counter and returns the id.
+func (db *MongoDb) insertPlant(ctx context.Context, plant Plant, opts WriteOptions) (int, error) {
+	log.Printf("Inserting new Plant into MongoDB: %v\n", plant.PrettyString())
+
 	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
-	result, err := collection.InsertOne(context.TODO(), doc)
-	if err != nil {
+	insert := func() error {
+		newId, err := db.generateNewId(ctx)
+		if err != nil {
+			return err
+		}
+		plant.Id = newId
+		plant.Version = 1
+
+		// Convert Plant object into BSON doc
+		_, doc, err := bson.MarshalValue(plant)
+		if err != nil {
+			return errors.Wrap(err, "Plant to BSON conversion failed")
+		}
+
+		// Insert plant into DB
+		result, err := collection.InsertOne(ctx, doc)
+		if err == nil {
+			log.Println("Inserted Plant into MongoDB. _id: ", result.InsertedID)
+			return db.recordRevision(ctx, newRevision(RevisionActionCreate, nil, plant, opts))
+		}
+		if isDuplicateIdError(err) {
+			log.Printf("Plant id %v is already in use\n", newId)
+			return err
+		}
 		if mongo.IsDuplicateKeyError(err) {
 			return &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
 		}
 		return errors.Wrap(err, "MongoDB insertOne failed")
 	}
+	if err := retryDuplicateIds(insert, func() error { return db.syncIdCounter(ctx) }); err != nil {
+		return 0, err
+	}
+	return plant.Id, nil
+}
 
-	log.Println("Inserted Plant into MongoDB. _id: ", result.InsertedID)
-	return nil
+// retryDuplicateIds runs insert until it doesn't fail on an id which is
+// already in use, which happens when a Plant was given its id without going
+// through the counter, e.g. by an upsert. resync catches the counter up
+// between attempts.
+func retryDuplicateIds(insert func() error, resync func() error) error {
+	for attempt := 1; attempt <= maxIdAllocationAttempts; attempt++ {
+		err := insert()
+		if !isDuplicateIdError(err) {
+			return err
+		}
+		log.Printf("Retrying with a new Plant id (attempt %v of %v)\n", attempt, maxIdAllocationAttempts)
+		if err := resync(); err != nil {
+			return err
+		}
+	}
+	return errors.Errorf("no free Plant id found after %v attempts", maxIdAllocationAttempts)
+}
+
+func (db *MongoDb) UpsertPlant(ctx context.Context, id int, plant Plant, opts WriteOptions) (int, error) {
+	version, _, err := db.upsertPlant(ctx, id, plant, opts)
+	return version, err
 }
 
-func (db *MongoDb) UpsertPlant(id int, plant Plant) error {
+// upsertPlant writes plant with the given id and returns its new version and
+// whether it was created. The replaced Plant comes from the update itself, so
+// its revision can't be confused by a concurrent write.
+func (db *MongoDb) upsertPlant(ctx context.Context, id int, plant Plant, opts WriteOptions) (int, bool, error) {
 	log.Printf("Upserting Plant with id %v into MongoDB: %v\n", id, plant.PrettyString())
 
-	// Convert Plant object into BSON doc
-	_, doc, err := bson.MarshalValue(plant)
+	// Convert Plant object into BSON doc of the fields to set
+	set, err := plantToSetDocument(plant)
 	if err != nil {
-		return errors.Wrap(err, "Plant to BSON conversion failed")
+		return 0, false, err
 	}
 
-	// Upsert plant into DB
-	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	// Upsert plant into DB, incrementing its version. A new Plant gets version 1
+	// and a deleted Plant is replaced and restored.
 	filter := bson.D{{Key: "id", Value: id}}
-	options := options.Replace().SetUpsert(true)
-	result, err := collection.ReplaceOne(context.TODO(), filter, doc, options)
+	if opts.IfVersion != 0 {
+		filter = versionFilter(id, opts)
+	}
+	update := bson.D{{Key: "$set", Value: set}, {Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}}}
+	before, err := db.findOneAndUpdate(ctx, filter, update, opts.IfVersion == 0)
 	if err != nil {
 		if mongo.IsDuplicateKeyError(err) {
-			return &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
+			return 0, false, &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
 		}
-		return errors.Wrap(err, "MongoDB replaceOne failed")
+		return 0, false, err
+	}
+	if before == nil && opts.IfVersion != 0 {
+		return 0, false, &PreconditionFailedError{}
 	}
 
-	log.Printf("Upserted Plant into MongoDB. ModifiedCount: %v, UpsertedCount: %v\n", result.ModifiedCount, result.UpsertedCount)
-	return nil
+	plant.Id = id
+	plant.Version = 1
+	plant.DeletedAt = nil
+	action := RevisionActionCreate
+	if before != nil {
+		plant.Version = before.Version + 1
+		action = RevisionActionUpdate
+	}
+
+	log.Printf("Upserted Plant into MongoDB with id %v\n", id)
+	return plant.Version, before == nil, db.recordRevision(ctx, newRevision(action, before, plant, opts))
+}
+
+func (db *MongoDb) WritePlants(ctx context.Context, writes []PlantWrite, allOrNothing bool, opts WriteOptions) ([]PlantWriteResult, error) {
+	log.Printf("Writing batch of %v Plants into MongoDB\n", len(writes))
+	if !allOrNothing {
+		// Each item is written on its own, so one failed write doesn't stop the
+		// rest and upserts see the Plant they replace
+		results := make([]PlantWriteResult, len(writes))
+		for i, write := range writes {
+			var err error
+			if write.Id == 0 {
+				results[i].Id, err = db.insertPlant(ctx, write.Plant, opts)
+				results[i].Created = err == nil
+			} else {
+				results[i].Id = write.Id
+				_, results[i].Created, err = db.upsertPlant(ctx, write.Id, write.Plant, opts)
+			}
+			var conflictErr *ConflictError
+			if errors.As(err, &conflictErr) {
+				results[i] = PlantWriteResult{Err: err}
+			} else if err != nil {
+				return []PlantWriteResult{}, err
+			}
+		}
+		log.Println("Wrote batch into MongoDB")
+		return results, nil
+	}
+
+	// All-or-nothing batches run in a transaction, which needs a replica set
+	session, err := db.Driver.StartSession()
+	if err != nil {
+		return []PlantWriteResult{}, errors.Wrap(err, "MongoDB startSession failed")
+	}
+	defer session.EndSession(ctx)
+
+	var results []PlantWriteResult
+	_, err = session.WithTransaction(ctx, func(sessionContext mongo.SessionContext) (interface{}, error) {
+		var err error
+		if results, err = db.bulkWritePlants(sessionContext, writes, opts); err != nil {
+			return nil, err
+		}
+		if rollBackFailedBatch(results) {
+			return nil, &RolledBackError{}
+		}
+		return nil, nil
+	})
+	var rolledBackErr *RolledBackError
+	if err != nil && !errors.As(err, &rolledBackErr) {
+		return []PlantWriteResult{}, errors.Wrap(err, "MongoDB transaction failed")
+	}
+
+	log.Println("Wrote batch into MongoDB")
+	return results, nil
+}
+
+// bulkWritePlants writes an all-or-nothing batch with one ordered BulkWrite,
+// taking ids for all of its new Plants from the counter at once. It must run
+// in a transaction, which keeps the Plants it reads first from changing.
+func (db *MongoDb) bulkWritePlants(ctx context.Context, writes []PlantWrite, opts WriteOptions) ([]PlantWriteResult, error) {
+	results := make([]PlantWriteResult, len(writes))
+	creates := 0
+	upsertIds := make([]int, 0)
+	for _, write := range writes {
+		if write.Id == 0 {
+			creates++
+		} else {
+			upsertIds = append(upsertIds, write.Id)
+		}
+	}
+	nextId := 0
+	if creates > 0 {
+		lastId, err := db.generateNewIds(ctx, creates)
+		if err != nil {
+			return []PlantWriteResult{}, err
+		}
+		nextId = lastId - creates + 1
+	}
+	existing, err := db.findPlantsById(ctx, upsertIds)
+	if err != nil {
+		return []PlantWriteResult{}, err
+	}
+
+	// Build the write for each item, along with the Plant it will leave stored
+	models := make([]mongo.WriteModel, len(writes))
+	afters := make([]Plant, len(writes))
+	for i, write := range writes {
+		plant := write.Plant
+		if write.Id == 0 {
+			plant.Id = nextId
+			plant.Version = 1
+			nextId++
+			_, doc, err := bson.MarshalValue(plant)
+			if err != nil {
+				return []PlantWriteResult{}, errors.Wrap(err, "Plant to BSON conversion failed")
+			}
+			models[i] = mongo.NewInsertOneModel().SetDocument(doc)
+			results[i] = PlantWriteResult{Id: plant.Id, Created: true}
+		} else {
+			set, err := plantToSetDocument(plant)
+			if err != nil {
+				return []PlantWriteResult{}, err
+			}
+			update := bson.D{{Key: "$set", Value: set}, {Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}}}
+			models[i] = mongo.NewUpdateOneModel().SetFilter(bson.D{{Key: "id", Value: write.Id}}).SetUpdate(update).SetUpsert(true)
+			before, exists := existing[write.Id]
+			plant.Id = write.Id
+			plant.Version = before.Version + 1
+			plant.DeletedAt = nil
+			results[i] = PlantWriteResult{Id: write.Id, Created: !exists}
+		}
+		afters[i] = plant
+	}
+
+	collection := db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	_, err = collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(true))
+	if err != nil {
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+			return []PlantWriteResult{}, errors.Wrap(err, "MongoDB bulkWrite failed")
+		}
+		for _, writeErr := range bulkErr.WriteErrors {
+			if writeErr.Code != 11000 {
+				return []PlantWriteResult{}, errors.Wrap(err, "MongoDB bulkWrite failed")
+			}
+			conflictErr := &ConflictError{ConflictingKey: "name", ConflictingValue: writes[writeErr.Index].Plant.Name}
+			if strings.Contains(writeErr.Message, "index: id_1 ") {
+				conflictErr = &ConflictError{ConflictingKey: "id", ConflictingValue: fmt.Sprint(afters[writeErr.Index].Id)}
+			}
+			results[writeErr.Index] = PlantWriteResult{Err: conflictErr}
+		}
+		// An ordered write stops at its first error, leaving the rest undone
+		if len(bulkErr.WriteErrors) > 0 {
+			for i := bulkErr.WriteErrors[0].Index + 1; i < len(results); i++ {
+				results[i] = PlantWriteResult{Err: &RolledBackError{}}
+			}
+		}
+	}
+	// The server has already aborted a failed transaction, so there is no
+	// history to record and nothing more may be written in it
+	if rollBackFailedBatch(results) {
+		return results, nil
+	}
+
+	// Record the history of the writes which succeeded
+	revisions := make([]interface{}, 0, len(writes))
+	for i, result := range results {
+		if result.Err != nil {
+			continue
+		}
+		if before, exists := existing[result.Id]; exists && !result.Created {
+			revisions = append(revisions, newRevision(RevisionActionUpdate, &before, afters[i], opts))
+		} else {
+			revisions = append(revisions, newRevision(RevisionActionCreate, nil, afters[i], opts))
+		}
+	}
+	if len(revisions) > 0 {
+		revisionsCollection := db.Driver.Database(db.DbName).Collection(revisionsCollectionName)
+		if _, err := revisionsCollection.InsertMany(ctx, revisions); err != nil {
+			return []PlantWriteResult{}, errors.Wrap(err, "MongoDB insertMany of revisions failed")
+		}
+	}
+	return results, nil
+}
+
+// findPlantsById returns the stored Plants with the given ids, including
+// deleted ones, keyed by id.
+func (db *MongoDb) findPlantsById(ctx context.Context, ids []int) (map[int]Plant, error) {
+	plants := make(map[int]Plant)
+	if len(ids) == 0 {
+		return plants, nil
+	}
+	collection := db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	cursor, err := collection.Find(ctx, bson.D{{Key: "id", Value: bson.D{{Key: "$in", Value: ids}}}})
+	if err != nil {
+		return nil, errors.Wrap(err, "MongoDB find failed")
+	}
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return nil, errors.Wrap(err, "MongoDB decode failed")
+	}
+	for _, result := range results {
+		var plant Plant
+		if err := bsonToPlant(result, &plant); err != nil {
+			return nil, errors.Wrap(err, "BSON to Plant conversion failed")
+		}
+		plants[plant.Id] = plant
+	}
+	return plants, nil
+}
+
+func (db *MongoDb) PatchPlant(ctx context.Context, id int, changes map[string]interface{}, opts WriteOptions) (int, error) {
+	log.Printf("Patching Plant with id %v in MongoDB: %v\n", id, changes)
+
+	// Set only the changed fields
+	update := bson.D{{Key: "$set", Value: changes}, {Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}}}
+	before, err := db.findOneAndUpdate(ctx, versionFilter(id, opts), update, false)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return 0, &ConflictError{ConflictingKey: "name", ConflictingValue: fmt.Sprint(changes["name"])}
+		}
+		return 0, err
+	}
+	if before == nil {
+		if opts.IfVersion != 0 {
+			return 0, &PreconditionFailedError{}
+		}
+		return 0, &NotFoundError{}
+	}
+	plant, err := applyPlantChanges(*before, changes)
+	if err != nil {
+		return 0, err
+	}
+	plant.Version = before.Version + 1
+
+	log.Printf("Patched Plant in MongoDB with id %v\n", id)
+	return plant.Version, db.recordRevision(ctx, newRevision(RevisionActionUpdate, before, plant, opts))
 }
 
-func (db *MongoDb) DeletePlant(id int) error {
+func (db *MongoDb) DeletePlant(ctx context.Context, id int, opts WriteOptions) error {
 	log.Printf("Deleting Plant with id %v in MongoDB\n", id)
 
+	// Deleted Plants are kept, so they can be restored
+	deletedAt := time.Now().UTC()
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "deletedAt", Value: deletedAt}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	before, err := db.findOneAndUpdate(ctx, versionFilter(id, opts), update, false)
+	if err != nil {
+		return err
+	}
+	if before == nil {
+		if opts.IfVersion != 0 {
+			return &PreconditionFailedError{}
+		}
+		log.Println("Deleted Plant in MongoDB. DeletedCount: 0")
+		return nil
+	}
+	plant := *before
+	plant.DeletedAt = &deletedAt
+	plant.Version++
+
+	log.Println("Deleted Plant in MongoDB. DeletedCount: 1")
+	return db.recordRevision(ctx, newRevision(RevisionActionDelete, before, plant, opts))
+}
+
+func (db *MongoDb) GetDeletedPlants(ctx context.Context) ([]Plant, error) {
+	log.Println("Finding deleted Plants in MongoDB")
+	filter := bson.D{{Key: "deletedAt", Value: bson.D{{Key: "$ne", Value: nil}}}}
+	findOptions := options.Find().SetSort(bson.D{{Key: "id", Value: 1}})
 	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
-	filter := bson.D{{Key: "id", Value: id}}
-	opts := options.Delete().SetHint(bson.D{{Key: "id", Value: 1}})
-	result, err := collection.DeleteOne(context.TODO(), filter, opts)
+	cursor, err := collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return []Plant{}, errors.Wrap(err, "MongoDB find failed")
+	}
+
+	// Decode all documents
+	var results []bson.M
+	if err = cursor.All(ctx, &results); err != nil {
+		return []Plant{}, errors.Wrap(err, "MongoDB decode failed")
+	}
+
+	// Parse docs into Plant objects
+	plants := make([]Plant, 0, len(results))
+	for _, result := range results {
+		var plant Plant
+		if err := bsonToPlant(result, &plant); err != nil {
+			return []Plant{}, errors.Wrap(err, "BSON to Plant conversion failed")
+		}
+		plants = append(plants, plant)
+	}
+
+	log.Println("Retrieved deleted Plants from MongoDB. Item count: ", len(plants))
+	return plants, nil
+}
+
+func (db *MongoDb) RestorePlant(ctx context.Context, id int, opts WriteOptions) (int, error) {
+	log.Printf("Restoring Plant with id %v in MongoDB\n", id)
+
+	// Find the deleted Plant, whose name may since have been reused
+	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	filter := bson.D{{Key: "id", Value: id}, {Key: "deletedAt", Value: bson.D{{Key: "$ne", Value: nil}}}}
+	var result bson.D
+	if err := collection.FindOne(ctx, filter).Decode(&result); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, &NotFoundError{}
+		}
+		return 0, errors.Wrap(err, "MongoDB findOne failed")
+	}
+	var plant Plant
+	if err := bsonToPlant(result, &plant); err != nil {
+		return 0, errors.Wrap(err, "BSON to Plant conversion failed")
+	}
+
+	update := bson.D{
+		{Key: "$set", Value: bson.D{{Key: "deletedAt", Value: nil}}},
+		{Key: "$inc", Value: bson.D{{Key: "version", Value: 1}}},
+	}
+	before, err := db.findOneAndUpdate(ctx, filter, update, false)
+	if err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return 0, &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
+		}
+		return 0, err
+	}
+	if before == nil {
+		return 0, &NotFoundError{}
+	}
+	plant = *before
+	plant.DeletedAt = nil
+	plant.Version++
+
+	log.Printf("Restored Plant in MongoDB with id %v\n", id)
+	return plant.Version, db.recordRevision(ctx, newRevision(RevisionActionRestore, before, plant, opts))
+}
+
+func (db *MongoDb) PurgePlant(ctx context.Context, id int) error {
+	log.Printf("Purging Plant with id %v in MongoDB\n", id)
+
+	// Only Plants which have already been deleted can be purged
+	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	filter := bson.D{{Key: "id", Value: id}, {Key: "deletedAt", Value: bson.D{{Key: "$ne", Value: nil}}}}
+	result, err := collection.DeleteOne(ctx, filter)
 	if err != nil {
 		return errors.Wrap(err, "MongoDB deleteOne failed")
 	}
+	if result.DeletedCount == 0 {
+		return &NotFoundError{}
+	}
+
+	// Purging is permanent, so the history goes too
+	revisions := *db.Driver.Database(db.DbName).Collection(revisionsCollectionName)
+	if _, err := revisions.DeleteMany(ctx, bson.D{{Key: "plantId", Value: id}}); err != nil {
+		return errors.Wrap(err, "MongoDB deleteMany failed")
+	}
+
+	log.Printf("Purged Plant in MongoDB with id %v\n", id)
+	return nil
+}
+
+func (db *MongoDb) GetPlantHistory(ctx context.Context, id int) ([]PlantRevision, error) {
+	log.Printf("Finding history of Plant with id %v in MongoDB\n", id)
+	revisions := *db.Driver.Database(db.DbName).Collection(revisionsCollectionName)
+	findOptions := options.Find().SetSort(bson.D{{Key: "revision", Value: 1}})
+	cursor, err := revisions.Find(ctx, bson.D{{Key: "plantId", Value: id}}, findOptions)
+	if err != nil {
+		return []PlantRevision{}, errors.Wrap(err, "MongoDB find failed")
+	}
+
+	history := make([]PlantRevision, 0)
+	if err = cursor.All(ctx, &history); err != nil {
+		return []PlantRevision{}, errors.Wrap(err, "MongoDB decode failed")
+	}
+
+	log.Println("Retrieved history from MongoDB. Item count: ", len(history))
+	return history, nil
+}
+
+func (db *MongoDb) GetPlantRevision(ctx context.Context, id int, revision int) (PlantRevision, error) {
+	log.Printf("Finding revision %v of Plant with id %v in MongoDB\n", revision, id)
+	revisions := *db.Driver.Database(db.DbName).Collection(revisionsCollectionName)
+	filter := bson.D{{Key: "plantId", Value: id}, {Key: "revision", Value: revision}}
+	var result PlantRevision
+	if err := revisions.FindOne(ctx, filter).Decode(&result); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return PlantRevision{}, &NotFoundError{}
+		}
+		return PlantRevision{}, errors.Wrap(err, "MongoDB findOne failed")
+	}
+	return result, nil
+}
+
+// findOneAndUpdate applies update to the Plant matching filter and returns
+// the Plant as it was beforehand, or nil if nothing matched.
+func (db *MongoDb) findOneAndUpdate(ctx context.Context, filter bson.D, update bson.D, upsert bool) (*Plant, error) {
+	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	updateOptions := options.FindOneAndUpdate().
+		SetUpsert(upsert).
+		SetReturnDocument(options.Before).
+		SetHint(bson.D{{Key: "id", Value: 1}})
+	var result bson.D
+	if err := collection.FindOneAndUpdate(ctx, filter, update, updateOptions).Decode(&result); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, nil
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		return nil, errors.Wrap(err, "MongoDB findOneAndUpdate failed")
+	}
+	var plant Plant
+	if err := bsonToPlant(result, &plant); err != nil {
+		return nil, errors.Wrap(err, "BSON to Plant conversion failed")
+	}
+	return &plant, nil
+}
 
-	log.Printf("Deleted Plant in MongoDB. DeletedCount: %v\n", result.DeletedCount)
+// recordRevision adds a write to the history of its Plant. The write itself
+// has already happened, so a failure here leaves a gap in the history.
+func (db *MongoDb) recordRevision(ctx context.Context, revision PlantRevision) error {
+	revisions := *db.Driver.Database(db.DbName).Collection(revisionsCollectionName)
+	if _, err := revisions.InsertOne(ctx, revision); err != nil {
+		return errors.Wrap(err, "MongoDB insertOne of revision failed")
+	}
 	return nil
 }
 
+// versionFilter matches the Plant with the given id, if it hasn't been
+// deleted and has the version required by opts.
+func versionFilter(id int, opts WriteOptions) bson.D {
+	filter := bson.D{{Key: "id", Value: id}, {Key: "deletedAt", Value: nil}}
+	if opts.IfVersion != 0 {
+		filter = append(filter, bson.E{Key: "version", Value: opts.IfVersion})
+	}
+	return filter
+}
+
+// plantToSetDocument converts plant into a BSON doc of every field except
+// the id and version, which are managed by the database.
+func plantToSetDocument(plant Plant) (bson.D, error) {
+	_, doc, err := bson.MarshalValue(plant)
+	if err != nil {
+		return nil, errors.Wrap(err, "Plant to BSON conversion failed")
+	}
+	var fields bson.D
+	if err := bson.Unmarshal(doc, &fields); err != nil {
+		return nil, errors.Wrap(err, "BSON unmarshall failed")
+	}
+	set := bson.D{}
+	for _, field := range fields {
+		if field.Key != "id" && field.Key != "version" {
+			set = append(set, field)
+		}
+	}
+	return set, nil
+}
+
+func plantFilterToBson(filter PlantFilter) bson.D {
+	doc := bson.D{{Key: "deletedAt", Value: nil}}
+	if filter.Name != "" {
+		doc = append(doc, bson.E{Key: "name", Value: filter.Name})
+	}
+	if filter.NamePrefix != "" {
+		// An anchored, case-sensitive regex can use the name index
+		doc = append(doc, bson.E{Key: "name", Value: primitive.Regex{Pattern: "^" + regexp.QuoteMeta(filter.NamePrefix)}})
+	}
+	if filter.Slug != "" {
+		// Match the names plantSlug maps to the slug, whatever separates
+		// and surrounds its words
+		words := slugWords(filter.Slug)
+		pattern := "^[^a-z0-9]*" + strings.Join(words, "[^a-z0-9]+") + "[^a-z0-9]*$"
+		doc = append(doc, bson.E{Key: "name", Value: primitive.Regex{Pattern: pattern, Options: "i"}})
+	}
+	if filter.Light != "" {
+		doc = append(doc, bson.E{Key: "light", Value: filter.Light})
+	}
+	if filter.Humidity != "" {
+		doc = append(doc, bson.E{Key: "humidity", Value: filter.Humidity})
+	}
+	if filter.Water != "" {
+		doc = append(doc, bson.E{Key: "water", Value: filter.Water})
+	}
+	return doc
+}
+
+// sortFieldsToBson converts sortFields into a sort document, ending with id
+// so that pages are stable between requests.
+func sortFieldsToBson(sortFields []SortField) bson.D {
+	doc := bson.D{}
+	sortsById := false
+	for _, sortField := range sortFields {
+		direction := 1
+		if sortField.Descending {
+			direction = -1
+		}
+		doc = append(doc, bson.E{Key: sortField.Field, Value: direction})
+		sortsById = sortsById || sortField.Field == "id"
+	}
+	if !sortsById {
+		doc = append(doc, bson.E{Key: "id", Value: 1})
+	}
+	return doc
+}
+
 func bsonToPlant(result interface{}, plant *Plant) error {
 	doc, err := bson.Marshal(result)
 	if err != nil {
@@ -191,27 +942,91 @@ func bsonToPlant(result interface{}, plant *Plant) error {
 	return nil
 }
 
-func (db *MongoDb) generateNewId() (int, error) {
+// generateNewId atomically increments the Plant id counter, so concurrent
+// callers are never given the same id.
+func (db *MongoDb) generateNewId(ctx context.Context) (int, error) {
+	return db.generateNewIds(ctx, 1)
+}
+
+// generateNewIds reserves count consecutive ids in one round trip and
+// returns the last of them.
+func (db *MongoDb) generateNewIds(ctx context.Context, count int) (int, error) {
+	log.Printf("Incrementing Plant id counter in MongoDB by %v\n", count)
+	counters := *db.Driver.Database(db.DbName).Collection(countersCollectionName)
+	filter := bson.D{{Key: "_id", Value: db.CollectionName}}
+	update := bson.D{{Key: "$inc", Value: bson.D{{Key: "seq", Value: count}}}}
+	options := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	var counter struct {
+		Seq int `bson:"seq"`
+	}
+	if err := counters.FindOneAndUpdate(ctx, filter, update, options).Decode(&counter); err != nil {
+		return -1, errors.Wrap(err, "MongoDB findOneAndUpdate failed")
+	}
+
+	log.Printf("New plant ID: %v\n", counter.Seq)
+	return counter.Seq, nil
+}
+
+// syncIdCounter moves the Plant id counter up to the highest id in use, for
+// Plants inserted without going through the counter.
+func (db *MongoDb) syncIdCounter(ctx context.Context) error {
 	log.Println("Getting max ID from MongoDB")
 	collection := *db.Driver.Database(db.DbName).Collection(db.CollectionName)
-	filter := bson.D{}
-	options := options.FindOne().SetSort(bson.D{{Key: "id", Value: -1}})
+	findOptions := options.FindOne().SetSort(bson.D{{Key: "id", Value: -1}})
 	var result bson.D
-	err := collection.FindOne(context.TODO(), filter, options).Decode(&result)
+	err := collection.FindOne(ctx, bson.D{}, findOptions).Decode(&result)
 	if err != nil {
-		if errors.As(err, &mongo.ErrNoDocuments) {
-			log.Println("No Plants in database. New ID is 1.")
-			return 1, nil
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			log.Println("No Plants in database. Plant id counter is unchanged.")
+			return nil
 		}
-		return -1, errors.Wrap(err, "MongoDB findOne failed")
+		return errors.Wrap(err, "MongoDB findOne failed")
 	}
 
 	var plant Plant
 	if err = bsonToPlant(result, &plant); err != nil {
-		return -1, errors.Wrap(err, "BSON to Plant conversion failed")
+		return errors.Wrap(err, "BSON to Plant conversion failed")
+	}
+
+	counters := *db.Driver.Database(db.DbName).Collection(countersCollectionName)
+	filter := bson.D{{Key: "_id", Value: db.CollectionName}}
+	update := bson.D{{Key: "$max", Value: bson.D{{Key: "seq", Value: plant.Id}}}}
+	if _, err := counters.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		return errors.Wrap(err, "MongoDB updateOne failed")
+	}
+
+	log.Printf("Plant id counter is at least %v\n", plant.Id)
+	return nil
+}
+
+// isDuplicateIdError reports whether err was caused by the unique index on
+// id rather than the one on name.
+func isDuplicateIdError(err error) bool {
+	var writeErr mongo.WriteException
+	if !errors.As(err, &writeErr) {
+		return false
+	}
+	for _, e := range writeErr.WriteErrors {
+		if e.Code == 11000 && strings.Contains(e.Message, "index: id_1 ") {
+			return true
+		}
 	}
+	return false
+}
+
+// isTimeoutError reports whether err was caused by a database operation
+// running past its deadline.
+func isTimeoutError(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err)
+}
 
-	newId := plant.Id + 1
-	log.Printf("New plant ID: %v\n", newId)
-	return newId, nil
+// isUnavailableError reports whether err was caused by the database not being
+// reachable, rather than by the operation. Writes which the server labels as
+// retryable failed because the primary went away, so they count too.
+func isUnavailableError(err error) bool {
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) && serverErr.HasErrorLabel("RetryableWriteError") {
+		return true
+	}
+	return mongo.IsNetworkError(err) || errors.Is(err, mongo.ErrClientDisconnected)
 }
@@ -0,0 +1,749 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDatabases returns a freshly connected instance of every Database
+// implementation which can run without external services. MongoDB is
+// included when MONGODB_TEST_URL is set.
+func testDatabases(t *testing.T) map[string]Database {
+	dbs := map[string]Database{
+		"memory": &MemoryDb{},
+		"bolt":   &BoltDb{Path: filepath.Join(t.TempDir(), "plants.db")},
+	}
+	for name, db := range dbs {
+		if err := db.Connect(context.Background()); err != nil {
+			t.Fatalf("%v: connect failed: %v", name, err)
+		}
+		t.Cleanup(func() { db.Disconnect(context.Background()) })
+	}
+	if url := os.Getenv("MONGODB_TEST_URL"); url != "" {
+		dbs["mongodb"] = testMongoDb(t, url)
+	}
+	return dbs
+}
+
+func testMongoDb(t *testing.T, url string) *MongoDb {
+	viper.Set("MongoDb.DbUrl", url)
+	db := &MongoDb{DbName: fmt.Sprintf("plantsdb_test_%v", time.Now().UnixNano()), CollectionName: "plants"}
+	if err := db.Connect(context.Background()); err != nil {
+		t.Fatalf("mongodb: connect failed: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Driver.Database(db.DbName).Drop(context.TODO())
+		db.Disconnect(context.Background())
+	})
+
+	// Same indexes as scripts/db_creation.txt
+	indexes := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "name", Value: 1}, {Key: "deletedAt", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{
+			Keys:    bson.D{{Key: "name", Value: "text"}, {Key: "otherNames", Value: "text"}},
+			Options: options.Index().SetWeights(bson.D{{Key: "name", Value: 2}, {Key: "otherNames", Value: 1}}),
+		},
+	}
+	collection := db.Driver.Database(db.DbName).Collection(db.CollectionName)
+	if _, err := collection.Indexes().CreateMany(context.TODO(), indexes); err != nil {
+		t.Fatalf("mongodb: index creation failed: %v", err)
+	}
+	revisionIndex := mongo.IndexModel{Keys: bson.D{{Key: "plantId", Value: 1}, {Key: "revision", Value: 1}}, Options: options.Index().SetUnique(true)}
+	if _, err := db.Driver.Database(db.DbName).Collection(revisionsCollectionName).Indexes().CreateOne(context.TODO(), revisionIndex); err != nil {
+		t.Fatalf("mongodb: revision index creation failed: %v", err)
+	}
+	return db
+}
+
+func TestDatabasePing(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Act
+			err := db.Ping(context.Background())
+
+			// Assert
+			if err != nil {
+				t.Errorf("Ping returned an unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDatabaseCreateAndGet(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			plant := Plant{Name: "Plant A", OtherNames: []string{"Other name A"}, Light: "low", Humidity: "high", Water: "low"}
+
+			// Act
+			if err := db.CreatePlant(context.Background(), plant, WriteOptions{}); err != nil {
+				t.Fatalf("CreatePlant returned unexpected error: %v", err)
+			}
+			if err := db.CreatePlant(context.Background(), Plant{Name: "Plant B"}, WriteOptions{}); err != nil {
+				t.Fatalf("CreatePlant returned unexpected error: %v", err)
+			}
+			result, err := db.GetPlantById(context.Background(), 1)
+
+			// Assert
+			if err != nil {
+				t.Fatalf("GetPlantById returned unexpected error: %v", err)
+			}
+			plant.Id = 1
+			if result.PrettyString() != plant.PrettyString() {
+				t.Errorf("GetPlantById returned unexpected plant: got %v, want %v", result.PrettyString(), plant.PrettyString())
+			}
+			plants, err := db.GetAllPlants(context.Background())
+			if err != nil {
+				t.Fatalf("GetAllPlants returned unexpected error: %v", err)
+			}
+			if len(plants) != 2 || plants[0].Id != 1 || plants[1].Id != 2 {
+				t.Errorf("GetAllPlants returned unexpected plants: %v", plants)
+			}
+		})
+	}
+}
+
+func TestDatabaseNameConflicts(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Plant B"}, WriteOptions{})
+
+			// Act
+			createErr := db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+			_, upsertErr := db.UpsertPlant(context.Background(), 2, Plant{Name: "Plant A"}, WriteOptions{})
+			_, sameIdErr := db.UpsertPlant(context.Background(), 1, Plant{Name: "Plant A", Light: "low"}, WriteOptions{})
+
+			// Assert
+			var conflictErr *ConflictError
+			if !errors.As(createErr, &conflictErr) || conflictErr.ConflictingValue != "Plant A" {
+				t.Errorf("CreatePlant returned unexpected error: got %v, want ConflictError", createErr)
+			}
+			if !errors.As(upsertErr, &conflictErr) {
+				t.Errorf("UpsertPlant returned unexpected error: got %v, want ConflictError", upsertErr)
+			}
+			if sameIdErr != nil {
+				t.Errorf("UpsertPlant of the same plant returned unexpected error: %v", sameIdErr)
+			}
+		})
+	}
+}
+
+func TestDatabaseUpsertAndDelete(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+
+			// Act
+			_, upsertErr := db.UpsertPlant(context.Background(), 5, Plant{Name: "Plant B"}, WriteOptions{})
+			deleteErr := db.DeletePlant(context.Background(), 1, WriteOptions{})
+			deleteMissingErr := db.DeletePlant(context.Background(), 42, WriteOptions{})
+
+			// Assert
+			if upsertErr != nil || deleteErr != nil || deleteMissingErr != nil {
+				t.Fatalf("unexpected errors: upsert %v, delete %v, delete missing %v", upsertErr, deleteErr, deleteMissingErr)
+			}
+			if _, err := db.GetPlantById(context.Background(), 1); !errors.Is(err, &NotFoundError{}) {
+				t.Errorf("GetPlantById of deleted plant returned unexpected error: got %v, want NotFoundError", err)
+			}
+			if plant, err := db.GetPlantById(context.Background(), 5); err != nil || plant.Name != "Plant B" {
+				t.Errorf("GetPlantById of upserted plant returned unexpected result: %v, %v", plant, err)
+			}
+		})
+	}
+}
+
+func TestDatabaseConcurrentCreatesGetUniqueIds(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			const plantCount = 50
+			db.UpsertPlant(context.Background(), 3, Plant{Name: "Plant with explicit id"}, WriteOptions{})
+			var wg sync.WaitGroup
+			errs := make(chan error, plantCount)
+
+			// Act
+			for i := 0; i < plantCount; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					errs <- db.CreatePlant(context.Background(), Plant{Name: fmt.Sprintf("Plant %v", i)}, WriteOptions{})
+				}(i)
+			}
+			wg.Wait()
+			close(errs)
+
+			// Assert
+			for err := range errs {
+				if err != nil {
+					t.Errorf("CreatePlant returned unexpected error: %v", err)
+				}
+			}
+			plants, err := db.GetAllPlants(context.Background())
+			if err != nil {
+				t.Fatalf("GetAllPlants returned unexpected error: %v", err)
+			}
+			if len(plants) != plantCount+1 {
+				t.Errorf("GetAllPlants returned unexpected item count: got %v, want %v", len(plants), plantCount+1)
+			}
+			ids := make(map[int]bool)
+			for _, plant := range plants {
+				if ids[plant.Id] {
+					t.Errorf("id %v was allocated more than once", plant.Id)
+				}
+				ids[plant.Id] = true
+			}
+		})
+	}
+}
+
+func TestIsDuplicateIdError(t *testing.T) {
+	duplicateKeyError := func(index string) error {
+		return mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+			Code:    11000,
+			Message: fmt.Sprintf("E11000 duplicate key error collection: plantsdb.plants index: %v dup key: { : 3 }", index),
+		}}}
+	}
+	tests := []struct {
+		testName string
+		err      error
+		expected bool
+	}{
+		{"duplicate_id_is_detected", duplicateKeyError("id_1"), true},
+		{"wrapped_duplicate_id_is_detected", fmt.Errorf("insert failed: %w", duplicateKeyError("id_1")), true},
+		{"duplicate_name_is_not_an_id", duplicateKeyError("name_1_deletedAt_1"), false},
+		{"duplicate_revision_is_not_an_id", duplicateKeyError("plantId_1_revision_1"), false},
+		{"other_write_error_is_not_an_id", mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121, Message: "index: id_1 "}}}, false},
+		{"no_error_is_not_an_id", nil, false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Act
+			actual := isDuplicateIdError(tc.err)
+
+			// Assert
+			if actual != tc.expected {
+				t.Errorf("isDuplicateIdError returned %v, want %v", actual, tc.expected)
+			}
+		})
+	}
+}
+
+func TestRetryDuplicateIds(t *testing.T) {
+	duplicateIdErr := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error collection: plantsdb.plants index: id_1 dup key: { : 3 }"}}}
+	tests := []struct {
+		testName        string
+		insertErrs      []error
+		resyncErr       error
+		expectedInserts int
+		expectedResyncs int
+		expectedErr     string
+	}{
+		{"first_free_id_is_used", []error{nil}, nil, 1, 0, ""},
+		{"taken_id_is_retried_after_resync", []error{duplicateIdErr, nil}, nil, 2, 1, ""},
+		{"name_conflict_is_not_retried", []error{&ConflictError{ConflictingKey: "name", ConflictingValue: "Plant A"}}, nil, 1, 0, "the request conflicts with the target resource (conflicting key: name, conflicting value: Plant A)"},
+		{"failed_resync_stops_retries", []error{duplicateIdErr}, errors.New("resync failed"), 1, 1, "resync failed"},
+		{"gives_up_after_max_attempts", []error{duplicateIdErr, duplicateIdErr, duplicateIdErr, duplicateIdErr, duplicateIdErr, nil}, nil, maxIdAllocationAttempts, maxIdAllocationAttempts, fmt.Sprintf("no free Plant id found after %v attempts", maxIdAllocationAttempts)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			inserts, resyncs := 0, 0
+			insert := func() error {
+				inserts++
+				return tc.insertErrs[inserts-1]
+			}
+			resync := func() error {
+				resyncs++
+				return tc.resyncErr
+			}
+
+			// Act
+			err := retryDuplicateIds(insert, resync)
+
+			// Assert
+			actualErr := ""
+			if err != nil {
+				actualErr = err.Error()
+			}
+			if actualErr != tc.expectedErr {
+				t.Errorf("retryDuplicateIds returned unexpected error: got %v, want %v", actualErr, tc.expectedErr)
+			}
+			if inserts != tc.expectedInserts || resyncs != tc.expectedResyncs {
+				t.Errorf("retryDuplicateIds made unexpected calls: got %v inserts and %v resyncs, want %v and %v", inserts, resyncs, tc.expectedInserts, tc.expectedResyncs)
+			}
+		})
+	}
+}
+
+func TestDatabaseNegativeIdDoesNotResetIds(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+			db.UpsertPlant(context.Background(), -1, Plant{Name: "Plant B"}, WriteOptions{})
+
+			// Act
+			createErr := db.CreatePlant(context.Background(), Plant{Name: "Plant C"}, WriteOptions{})
+			plant, err := db.GetPlantById(context.Background(), 2)
+
+			// Assert
+			if createErr != nil {
+				t.Fatalf("CreatePlant returned unexpected error: %v", createErr)
+			}
+			if err != nil || plant.Name != "Plant C" {
+				t.Errorf("CreatePlant after a negative id was given an unexpected id: %v, %v", plant, err)
+			}
+		})
+	}
+}
+
+func TestDatabaseGetPlantsPages(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			for _, plantName := range []string{"Plant A", "Plant B", "Plant C"} {
+				db.CreatePlant(context.Background(), Plant{Name: plantName}, WriteOptions{})
+			}
+
+			// Act
+			plants, total, err := db.GetPlants(context.Background(), PlantQuery{Limit: 2, Offset: 1})
+
+			// Assert
+			if err != nil {
+				t.Fatalf("GetPlants returned unexpected error: %v", err)
+			}
+			if total != 3 {
+				t.Errorf("GetPlants returned unexpected total: got %v, want 3", total)
+			}
+			if len(plants) != 2 || plants[0].Name != "Plant B" || plants[1].Name != "Plant C" {
+				t.Errorf("GetPlants returned unexpected plants: %v", plants)
+			}
+		})
+	}
+}
+
+func TestDatabaseGetPlantsFilters(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Ficus Tineke", Light: "bright direct", Water: "moderate"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Ficus Elastica", Light: "bright indirect", Water: "moderate"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Aloe Juvenna", Light: "bright indirect", Water: "low"}, WriteOptions{})
+
+			// Act
+			byPrefix, prefixTotal, prefixErr := db.GetPlants(context.Background(), PlantQuery{Filter: PlantFilter{NamePrefix: "Ficus", Light: "bright indirect"}})
+			byName, nameTotal, nameErr := db.GetPlants(context.Background(), PlantQuery{Filter: PlantFilter{Name: "Aloe Juvenna"}})
+
+			// Assert
+			if prefixErr != nil || nameErr != nil {
+				t.Fatalf("GetPlants returned unexpected errors: %v, %v", prefixErr, nameErr)
+			}
+			if prefixTotal != 1 || len(byPrefix) != 1 || byPrefix[0].Name != "Ficus Elastica" {
+				t.Errorf("GetPlants by name prefix returned unexpected plants: %v", byPrefix)
+			}
+			if nameTotal != 1 || len(byName) != 1 || byName[0].Name != "Aloe Juvenna" {
+				t.Errorf("GetPlants by name returned unexpected plants: %v", byName)
+			}
+		})
+	}
+}
+
+func TestDatabaseStreamPlants(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Ficus Tineke", Water: "moderate"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Aloe Juvenna", Water: "low"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Ficus Elastica", Water: "moderate"}, WriteOptions{})
+			db.DeletePlant(context.Background(), 1, WriteOptions{})
+
+			// Act
+			names := make([]string, 0)
+			err := db.StreamPlants(context.Background(), PlantFilter{Water: "moderate"}, func(plant Plant) error {
+				names = append(names, plant.Name)
+				return nil
+			})
+			stopErr := errors.New("stop")
+			stopped := 0
+			streamErr := db.StreamPlants(context.Background(), PlantFilter{}, func(plant Plant) error {
+				stopped++
+				return stopErr
+			})
+
+			// Assert
+			if err != nil {
+				t.Fatalf("StreamPlants returned an unexpected error: %v", err)
+			}
+			if len(names) != 1 || names[0] != "Ficus Elastica" {
+				t.Errorf("StreamPlants returned unexpected plants: %v", names)
+			}
+			if streamErr != stopErr || stopped != 1 {
+				t.Errorf("StreamPlants didn't stop at the first error: got %v after %v plants", streamErr, stopped)
+			}
+		})
+	}
+}
+
+func TestDatabaseStreamPlantsStopsWhenCancelled(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Ficus Tineke"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Aloe Juvenna"}, WriteOptions{})
+			ctx, cancel := context.WithCancel(context.Background())
+
+			// Act
+			streamed := 0
+			err := db.StreamPlants(ctx, PlantFilter{}, func(plant Plant) error {
+				streamed++
+				cancel()
+				return nil
+			})
+
+			// Assert
+			if !errors.Is(err, context.Canceled) || streamed != 1 {
+				t.Errorf("StreamPlants didn't stop when cancelled: got %v after %v plants", err, streamed)
+			}
+		})
+	}
+}
+
+func TestDbContext(t *testing.T) {
+	// Arrange
+	viper.Set("Database.Timeouts.Read", "50ms")
+	defer viper.Set("Database.Timeouts.Read", nil)
+
+	// Act
+	readCtx, cancelRead := dbContext(context.Background(), dbOperationRead)
+	defer cancelRead()
+	writeCtx, cancelWrite := dbContext(context.Background(), dbOperationWrite)
+	defer cancelWrite()
+
+	// Assert
+	if deadline, ok := readCtx.Deadline(); !ok || time.Until(deadline) > 50*time.Millisecond {
+		t.Errorf("dbContext returned an unexpected read deadline: %v, %v", deadline, ok)
+	}
+	if _, ok := writeCtx.Deadline(); ok {
+		t.Errorf("dbContext returned a write deadline, though none is configured")
+	}
+}
+
+func TestDatabaseGetPlantsSorts(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Ficus Tineke", Water: "moderate"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Aloe Juvenna", Water: "low"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Ficus Elastica", Water: "moderate"}, WriteOptions{})
+
+			// Act
+			plants, _, err := db.GetPlants(context.Background(), PlantQuery{Sort: []SortField{{Field: "water", Descending: true}, {Field: "name"}}})
+
+			// Assert
+			if err != nil {
+				t.Fatalf("GetPlants returned unexpected error: %v", err)
+			}
+			names := make([]string, 0)
+			for _, plant := range plants {
+				names = append(names, plant.Name)
+			}
+			if strings.Join(names, ", ") != "Ficus Elastica, Ficus Tineke, Aloe Juvenna" {
+				t.Errorf("GetPlants returned unexpected order: %v", names)
+			}
+		})
+	}
+}
+
+func TestDatabaseSearchPlantsRanksByRelevance(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Ficus Elastica", OtherNames: []string{"Rubber Tree"}}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Dracaena Marginata", OtherNames: []string{"Dragon Tree"}}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Aloe Juvenna", OtherNames: []string{"Tiger Tooth Aloe"}}, WriteOptions{})
+
+			// Act
+			results, err := db.SearchPlants(context.Background(), "dragon tree", 10)
+
+			// Assert
+			if err != nil {
+				t.Fatalf("SearchPlants returned unexpected error: %v", err)
+			}
+			if len(results) != 2 || results[0].Name != "Dracaena Marginata" || results[1].Name != "Ficus Elastica" {
+				t.Errorf("SearchPlants returned unexpected results: %v", results)
+			}
+			if len(results) == 2 && results[0].Score <= results[1].Score {
+				t.Errorf("SearchPlants returned unexpected scores: %v, %v", results[0].Score, results[1].Score)
+			}
+		})
+	}
+}
+
+func TestDatabaseWritesIncrementVersion(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+
+			// Act
+			upsertVersion, upsertErr := db.UpsertPlant(context.Background(), 1, Plant{Name: "Plant A", Light: "low"}, WriteOptions{IfVersion: 1})
+			patchVersion, patchErr := db.PatchPlant(context.Background(), 1, map[string]interface{}{"water": "low"}, WriteOptions{})
+			_, staleUpsertErr := db.UpsertPlant(context.Background(), 1, Plant{Name: "Plant A"}, WriteOptions{IfVersion: 2})
+			_, stalePatchErr := db.PatchPlant(context.Background(), 1, map[string]interface{}{"water": "high"}, WriteOptions{IfVersion: 1})
+			staleDeleteErr := db.DeletePlant(context.Background(), 1, WriteOptions{IfVersion: 2})
+			_, missingUpsertErr := db.UpsertPlant(context.Background(), 2, Plant{Name: "Plant B"}, WriteOptions{IfVersion: 1})
+
+			// Assert
+			if upsertErr != nil || patchErr != nil {
+				t.Fatalf("unexpected errors: upsert %v, patch %v", upsertErr, patchErr)
+			}
+			if upsertVersion != 2 || patchVersion != 3 {
+				t.Errorf("writes returned unexpected versions: upsert %v, patch %v", upsertVersion, patchVersion)
+			}
+			for _, err := range []error{staleUpsertErr, stalePatchErr, staleDeleteErr, missingUpsertErr} {
+				if !errors.Is(err, &PreconditionFailedError{}) {
+					t.Errorf("write returned unexpected error: got %v, want PreconditionFailedError", err)
+				}
+			}
+			plant, err := db.GetPlantById(context.Background(), 1)
+			if err != nil || plant.Version != 3 || plant.Water != "low" {
+				t.Errorf("GetPlantById returned unexpected result: %v, %v", plant, err)
+			}
+			if _, err := db.GetPlantById(context.Background(), 2); !errors.Is(err, &NotFoundError{}) {
+				t.Errorf("conditional upsert created a plant: %v", err)
+			}
+		})
+	}
+}
+
+func TestDatabaseSoftDeleteAndRestore(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Plant B"}, WriteOptions{})
+
+			// Act
+			deleteErr := db.DeletePlant(context.Background(), 1, WriteOptions{})
+			reuseNameErr := db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+			_, restoreConflictErr := db.RestorePlant(context.Background(), 1, WriteOptions{})
+			db.DeletePlant(context.Background(), 3, WriteOptions{})
+			restoreVersion, restoreErr := db.RestorePlant(context.Background(), 1, WriteOptions{})
+
+			// Assert
+			if deleteErr != nil || reuseNameErr != nil || restoreErr != nil {
+				t.Fatalf("unexpected errors: delete %v, reuse name %v, restore %v", deleteErr, reuseNameErr, restoreErr)
+			}
+			var conflictErr *ConflictError
+			if !errors.As(restoreConflictErr, &conflictErr) {
+				t.Errorf("RestorePlant returned unexpected error: got %v, want ConflictError", restoreConflictErr)
+			}
+			plants, _ := db.GetAllPlants(context.Background())
+			if len(plants) != 2 || plants[0].Id != 1 || plants[0].Version != 3 || restoreVersion != 3 || plants[1].Id != 2 {
+				t.Errorf("GetAllPlants returned unexpected plants: %v", plants)
+			}
+			trash, _ := db.GetDeletedPlants(context.Background())
+			if len(trash) != 1 || trash[0].Id != 3 || trash[0].DeletedAt == nil {
+				t.Errorf("GetDeletedPlants returned unexpected plants: %v", trash)
+			}
+			if err := db.PurgePlant(context.Background(), 2); !errors.Is(err, &NotFoundError{}) {
+				t.Errorf("PurgePlant of live plant returned unexpected error: got %v, want NotFoundError", err)
+			}
+			if err := db.PurgePlant(context.Background(), 3); err != nil {
+				t.Errorf("PurgePlant returned unexpected error: %v", err)
+			}
+			if trash, _ := db.GetDeletedPlants(context.Background()); len(trash) != 0 {
+				t.Errorf("GetDeletedPlants returned purged plants: %v", trash)
+			}
+		})
+	}
+}
+
+func TestDatabaseRecordsPlantHistory(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			opts := WriteOptions{Actor: "tester"}
+			db.CreatePlant(context.Background(), Plant{Name: "Plant A", Water: "low"}, opts)
+			db.UpsertPlant(context.Background(), 1, Plant{Name: "Plant A", Water: "high"}, opts)
+			db.PatchPlant(context.Background(), 1, map[string]interface{}{"light": "low"}, opts)
+			db.DeletePlant(context.Background(), 1, opts)
+			db.RestorePlant(context.Background(), 1, opts)
+
+			// Act
+			history, historyErr := db.GetPlantHistory(context.Background(), 1)
+			revision, revisionErr := db.GetPlantRevision(context.Background(), 1, 2)
+			_, missingErr := db.GetPlantRevision(context.Background(), 1, 6)
+
+			// Assert
+			if historyErr != nil || revisionErr != nil {
+				t.Fatalf("unexpected errors: history %v, revision %v", historyErr, revisionErr)
+			}
+			expectedActions := []string{RevisionActionCreate, RevisionActionUpdate, RevisionActionUpdate, RevisionActionDelete, RevisionActionRestore}
+			if len(history) != len(expectedActions) {
+				t.Fatalf("GetPlantHistory returned unexpected revisions: %v", history)
+			}
+			for i, action := range expectedActions {
+				if history[i].Revision != i+1 || history[i].Action != action || history[i].Actor != "tester" || history[i].After == nil {
+					t.Errorf("revision %v is unexpected: %+v", i+1, history[i])
+				}
+			}
+			if history[0].Before != nil || history[3].After.DeletedAt == nil || history[4].After.DeletedAt != nil {
+				t.Errorf("GetPlantHistory returned unexpected states: %v", history)
+			}
+			if revision.Before == nil || revision.Before.Water != "low" || revision.After.Water != "high" || revision.After.Version != 2 {
+				t.Errorf("GetPlantRevision returned unexpected revision: %+v", revision)
+			}
+			if !errors.Is(missingErr, &NotFoundError{}) {
+				t.Errorf("GetPlantRevision returned unexpected error: got %v, want NotFoundError", missingErr)
+			}
+
+			// Purging removes the history, so the id starts afresh
+			db.DeletePlant(context.Background(), 1, opts)
+			db.PurgePlant(context.Background(), 1)
+			if history, _ := db.GetPlantHistory(context.Background(), 1); len(history) != 0 {
+				t.Errorf("GetPlantHistory returned purged revisions: %v", history)
+			}
+		})
+	}
+}
+
+func TestDatabaseWritePlants(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+			conflicting := []PlantWrite{{Plant: Plant{Name: "Plant B"}}, {Id: 1, Plant: Plant{Name: "Plant B"}}}
+			valid := []PlantWrite{{Plant: Plant{Name: "Plant C"}}, {Id: 1, Plant: Plant{Name: "Plant A", Water: "low"}}, {Id: 9, Plant: Plant{Name: "Plant D"}}}
+
+			// Act
+			rolledBack, rolledBackErr := db.WritePlants(context.Background(), conflicting, true, WriteOptions{})
+			afterRollBack, _ := db.GetAllPlants(context.Background())
+			bestEffort, bestEffortErr := db.WritePlants(context.Background(), conflicting, false, WriteOptions{})
+			written, writtenErr := db.WritePlants(context.Background(), valid, true, WriteOptions{})
+
+			// Assert
+			if rolledBackErr != nil || bestEffortErr != nil || writtenErr != nil {
+				t.Fatalf("unexpected errors: %v, %v, %v", rolledBackErr, bestEffortErr, writtenErr)
+			}
+			var conflictErr *ConflictError
+			var rolledBackItemErr *RolledBackError
+			if !errors.As(rolledBack[0].Err, &rolledBackItemErr) || !errors.As(rolledBack[1].Err, &conflictErr) {
+				t.Errorf("all-or-nothing batch returned unexpected results: %+v", rolledBack)
+			}
+			if len(afterRollBack) != 1 || afterRollBack[0].Name != "Plant A" {
+				t.Errorf("all-or-nothing batch left unexpected plants: %v", afterRollBack)
+			}
+			if bestEffort[0].Err != nil || !bestEffort[0].Created || !errors.As(bestEffort[1].Err, &conflictErr) {
+				t.Errorf("best-effort batch returned unexpected results: %+v", bestEffort)
+			}
+			if written[0].Err != nil || !written[0].Created || written[1].Err != nil || written[1].Created || written[2].Id != 9 || !written[2].Created {
+				t.Errorf("batch returned unexpected results: %+v", written)
+			}
+			plants, _ := db.GetAllPlants(context.Background())
+			if len(plants) != 4 || plants[0].Water != "low" || plants[0].Version != 2 || plants[3].Id != 9 {
+				t.Errorf("batch left unexpected plants: %v", plants)
+			}
+			if history, _ := db.GetPlantHistory(context.Background(), 1); len(history) != 2 {
+				t.Errorf("batch recorded unexpected history: %v", history)
+			}
+		})
+	}
+}
+
+func TestMongoDbWritePlantsRollsBackLateConflict(t *testing.T) {
+	url := os.Getenv("MONGODB_TEST_URL")
+	if url == "" {
+		t.Skip("MONGODB_TEST_URL is not set")
+	}
+
+	// Arrange
+	db := testMongoDb(t, url)
+	db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+	writes := []PlantWrite{{Plant: Plant{Name: "Plant B"}}, {Plant: Plant{Name: "Plant C"}}, {Plant: Plant{Name: "Plant A"}}}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Act
+	results, err := db.WritePlants(ctx, writes, true, WriteOptions{})
+
+	// Assert
+	if err != nil {
+		t.Fatalf("WritePlants returned an unexpected error: %v", err)
+	}
+	var conflictErr *ConflictError
+	var rolledBackErr *RolledBackError
+	if !errors.As(results[0].Err, &rolledBackErr) || !errors.As(results[1].Err, &rolledBackErr) || !errors.As(results[2].Err, &conflictErr) {
+		t.Errorf("WritePlants returned unexpected results: %+v", results)
+	}
+	if plants, _ := db.GetAllPlants(context.Background()); len(plants) != 1 {
+		t.Errorf("WritePlants left unexpected plants: %v", plants)
+	}
+	if history, _ := db.GetPlantHistory(context.Background(), 2); len(history) != 0 {
+		t.Errorf("WritePlants recorded unexpected history: %v", history)
+	}
+}
+
+func TestBoltDbConnectWaitsForLockUntilDeadline(t *testing.T) {
+	// Arrange
+	path := filepath.Join(t.TempDir(), "plants.db")
+	holder := &BoltDb{Path: path}
+	if err := holder.Connect(context.Background()); err != nil {
+		t.Fatalf("connect failed: %v", err)
+	}
+	defer holder.Disconnect(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+
+	// Act
+	err := (&BoltDb{Path: path}).Connect(ctx)
+
+	// Assert
+	if err == nil {
+		t.Fatal("Connect returned no error while another connection held the file")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Connect waited %v, past the deadline of its context", elapsed)
+	}
+}
+
+func TestDatabaseGetPlantsBySlug(t *testing.T) {
+	for name, db := range testDatabases(t) {
+		t.Run(name, func(t *testing.T) {
+			// Arrange
+			db.CreatePlant(context.Background(), Plant{Name: "Dracaena Marginata"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Dracaena Fragrans"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: " dracaena  marginata!"}, WriteOptions{})
+
+			// Act
+			plants, total, err := db.GetPlants(context.Background(), PlantQuery{Filter: PlantFilter{Slug: "dracaena-marginata"}})
+
+			// Assert
+			if err != nil {
+				t.Fatalf("GetPlants returned an unexpected error: %v", err)
+			}
+			if total != 2 || len(plants) != 2 || plants[0].Id != 1 || plants[1].Id != 3 {
+				t.Errorf("GetPlants by slug returned unexpected plants: %v", plants)
+			}
+		})
+	}
+}
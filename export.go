@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	exportFormatCsv    = "csv"
+	exportFormatNdjson = "ndjson"
+	exportFormatJson   = "json"
+)
+
+var exportContentTypes = map[string]string{
+	exportFormatCsv:    csvContentType,
+	exportFormatNdjson: "application/x-ndjson",
+	exportFormatJson:   "application/json",
+}
+
+// plantExporter writes Plants one at a time in an export format, so an
+// export never holds more than one Plant in memory.
+type plantExporter interface {
+	Write(plant Plant) error
+	// Flush writes any buffered data to the underlying writer.
+	Flush() error
+	// Close finishes the export. It must be called even if nothing was written.
+	Close() error
+}
+
+func newPlantExporter(format string, w io.Writer) plantExporter {
+	switch format {
+	case exportFormatCsv:
+		return &csvPlantExporter{writer: csv.NewWriter(w)}
+	case exportFormatNdjson:
+		return &jsonPlantExporter{writer: w, encoder: json.NewEncoder(w)}
+	default:
+		return &jsonPlantExporter{writer: w, encoder: json.NewEncoder(w), array: true}
+	}
+}
+
+// csvPlantExporter writes the same columns importPlantsCsv reads, so an
+// export can be imported again.
+type csvPlantExporter struct {
+	writer        *csv.Writer
+	headerWritten bool
+}
+
+func (exporter *csvPlantExporter) Write(plant Plant) error {
+	if err := exporter.writeHeader(); err != nil {
+		return err
+	}
+	return exporter.writer.Write([]string{
+		strconv.Itoa(plant.Id),
+		plant.Name,
+		strings.Join(plant.OtherNames, defaultOtherNamesDelimiter),
+		string(plant.Light),
+		string(plant.Humidity),
+		string(plant.Water),
+	})
+}
+
+func (exporter *csvPlantExporter) Flush() error {
+	exporter.writer.Flush()
+	return exporter.writer.Error()
+}
+
+func (exporter *csvPlantExporter) Close() error {
+	if err := exporter.writeHeader(); err != nil {
+		return err
+	}
+	return exporter.Flush()
+}
+
+func (exporter *csvPlantExporter) writeHeader() error {
+	if exporter.headerWritten {
+		return nil
+	}
+	exporter.headerWritten = true
+	return exporter.writer.Write([]string{"id", "name", "otherNames", "light", "humidity", "water"})
+}
+
+// jsonPlantExporter writes a JSON document per line, or a single JSON array
+// when array is set.
+type jsonPlantExporter struct {
+	writer  io.Writer
+	encoder *json.Encoder
+	array   bool
+	count   int
+}
+
+func (exporter *jsonPlantExporter) Write(plant Plant) error {
+	if exporter.array {
+		separator := ","
+		if exporter.count == 0 {
+			separator = "["
+		}
+		if _, err := io.WriteString(exporter.writer, separator); err != nil {
+			return err
+		}
+	}
+	exporter.count++
+	return exporter.encoder.Encode(plant)
+}
+
+func (exporter *jsonPlantExporter) Flush() error {
+	return nil
+}
+
+func (exporter *jsonPlantExporter) Close() error {
+	if !exporter.array {
+		return nil
+	}
+	closing := "]\n"
+	if exporter.count == 0 {
+		closing = "[]\n"
+	}
+	_, err := io.WriteString(exporter.writer, closing)
+	return err
+}
@@ -1,51 +1,313 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+)
+
+const (
+	batchModeAllOrNothing = "all-or-nothing"
+	batchModeBestEffort   = "best-effort"
+	maxBatchSize          = 500
+)
+
+const (
+	healthStatusUp   = "up"
+	healthStatusDown = "down"
+)
+
+const (
+	defaultPageLimit    = 20
+	maxPageLimit        = 100
+	exportFlushInterval = 100
 )
 
 func (api *Api) listPlants(w http.ResponseWriter, r *http.Request) {
 	log.Printf("GET %v\n", r.RequestURI)
 
-	plants, err := api.DB.GetAllPlants()
+	query, err := readPlantQuery(r)
+	if err != nil {
+		log.Printf("The Plant query is invalid: %v\n", err)
+		writeErrorResponse(w, r, 400, problemInvalidParameter, err.Error())
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationRead)
+	defer cancel()
+	plants, total, err := api.DB.GetPlants(ctx, query)
+	if err != nil {
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+
+	response := PlantListResponse{
+		Items:  plants,
+		Total:  total,
+		Limit:  query.Limit,
+		Offset: query.Offset,
+	}
+	if query.Offset+query.Limit < total {
+		response.Links.Next = pageLink(r, query.Limit, query.Offset+query.Limit)
+	}
+	if query.Offset > 0 {
+		prevOffset := query.Offset - query.Limit
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		response.Links.Prev = pageLink(r, query.Limit, prevOffset)
+	}
+	writeResponse(w, r, 200, response)
+}
+
+// exportPlants streams every Plant matching the listing filters in the
+// requested format. Once streaming has started the status can't change, so
+// a failure part way through can only cut the export short.
+func (api *Api) exportPlants(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+
+	params := r.URL.Query()
+	for param := range params {
+		if !plantExportParameters[param] {
+			log.Printf("The query parameter '%v' is not supported\n", param)
+			writeErrorResponse(w, r, 400, problemInvalidParameter, fmt.Sprintf("The query parameter '%v' is not supported", param))
+			return
+		}
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = exportFormatJson
+	}
+	contentType, ok := exportContentTypes[format]
+	if !ok {
+		log.Printf("Export format '%v' is not supported\n", format)
+		writeErrorResponse(w, r, 400, problemInvalidParameter, fmt.Sprintf("The format must be %v, %v or %v", exportFormatCsv, exportFormatNdjson, exportFormatJson))
+		return
+	}
+	filter, err := readPlantFilter(params)
+	if err != nil {
+		log.Printf("The Plant filter is invalid: %v\n", err)
+		writeErrorResponse(w, r, 400, problemInvalidParameter, err.Error())
+		return
+	}
+
+	// Nothing is written until the first Plant, so an error before then can
+	// still be reported properly
+	w.Header().Set("content-type", contentType)
+	w.Header().Set("content-disposition", fmt.Sprintf("attachment; filename=\"plants.%v\"", format))
+	exporter := newPlantExporter(format, w)
+	flusher, _ := w.(http.Flusher)
+	count := 0
+	ctx, cancel := dbContext(r.Context(), dbOperationExport)
+	defer cancel()
+	err = api.DB.StreamPlants(ctx, filter, func(plant Plant) error {
+		if err := exporter.Write(plant); err != nil {
+			return err
+		}
+		count++
+		if flusher != nil && count%exportFlushInterval == 0 {
+			if err := exporter.Flush(); err != nil {
+				return err
+			}
+			flusher.Flush()
+		}
+		return nil
+	})
 	if err != nil {
+		if count == 0 {
+			w.Header().Del("content-disposition")
+			writeDatabaseErrorResponse(w, r, err)
+			return
+		}
 		log.Printf("Error: %v\n", err)
-		writeErrorResponse(w, 500, "An error occurred while processing the request")
 		return
 	}
-	writeResponse(w, 200, plants)
+	if err := exporter.Close(); err != nil {
+		log.Printf("Error: %v\n", err)
+	}
 }
 
-func (api *Api) getPlant(w http.ResponseWriter, r *http.Request) {
+func (api *Api) searchPlants(w http.ResponseWriter, r *http.Request) {
 	log.Printf("GET %v\n", r.RequestURI)
 
-	// Retrieve plant ID
-	idStr := r.FormValue("id")
-	id, err := strconv.Atoi(idStr)
+	text := strings.TrimSpace(r.FormValue("q"))
+	if text == "" {
+		log.Println("No search text was given")
+		writeErrorResponse(w, r, 400, problemInvalidParameter, "The q parameter is required")
+		return
+	}
+	limit := defaultPageLimit
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			log.Printf("Limit '%v' is invalid", limitStr)
+			writeErrorResponse(w, r, 400, problemInvalidParameter, fmt.Sprintf("The limit must be an integer between 1 and %v", maxPageLimit))
+			return
+		}
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationRead)
+	defer cancel()
+	results, err := api.DB.SearchPlants(ctx, text, limit)
+	if err != nil {
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	writeResponse(w, r, 200, results)
+}
+
+func (api *Api) suggestPlants(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	if name == "" {
+		log.Println("No name was given")
+		writeErrorResponse(w, r, 400, problemInvalidParameter, "The name parameter is required")
+		return
+	}
+	limit := defaultPageLimit
+	if limitStr := r.FormValue("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			log.Printf("Limit '%v' is invalid", limitStr)
+			writeErrorResponse(w, r, 400, problemInvalidParameter, fmt.Sprintf("The limit must be an integer between 1 and %v", maxPageLimit))
+			return
+		}
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationRead)
+	defer cancel()
+	plants, err := api.DB.GetAllPlants(ctx)
 	if err != nil {
-		log.Printf("Plant Id '%v' is not an integer", idStr)
-		writeErrorResponse(w, 400, "The Plant id must be an integer")
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	writeResponse(w, r, 200, suggestPlantNames(plants, name, limit, minSuggestionScore))
+}
+
+// getHealth reports that the process is alive and serving requests. It
+// checks nothing else, so that a struggling dependency doesn't get the API
+// restarted.
+func (api *Api) getHealth(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+	writeResponse(w, r, 200, HealthResponse{Status: healthStatusUp})
+}
+
+// getReadiness reports whether the API should be sent requests: it isn't
+// shutting down and the database answers a ping.
+func (api *Api) getReadiness(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+
+	ctx, cancel := dbContext(r.Context(), dbOperationRead)
+	defer cancel()
+	start := time.Now()
+	err := api.DB.Ping(ctx)
+	database := DependencyHealth{Name: "database", Status: healthStatusUp, LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		log.Printf("The database is not ready: %v\n", err)
+		database.Status = healthStatusDown
+		database.Error = "The database did not answer a ping"
+	}
+
+	if !api.isReady() {
+		log.Println("The API is shutting down")
+	}
+	if !api.isReady() || err != nil {
+		writeResponse(w, r, 503, HealthResponse{Status: healthStatusDown, Checks: []DependencyHealth{database}})
+		return
+	}
+	writeResponse(w, r, 200, HealthResponse{Status: healthStatusUp, Checks: []DependencyHealth{database}})
+}
+
+// getVocabulary lists the values allowed for each level of a Plant, in
+// increasing order.
+func (api *Api) getVocabulary(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+	writeResponse(w, r, 200, VocabularyResponse{
+		Light:    lightVocabulary,
+		Humidity: humidityVocabulary,
+		Water:    waterVocabulary,
+	})
+}
+
+func (api *Api) getPlant(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+
+	id, ok := readPlantId(w, r)
+	if !ok {
 		return
 	}
 
-	plant, err := api.DB.GetPlantById(id)
+	ctx, cancel := dbContext(r.Context(), dbOperationRead)
+	defer cancel()
+	plant, err := api.DB.GetPlantById(ctx, id)
 	if err != nil {
 		if errors.Is(err, &NotFoundError{}) {
 			log.Println("The specified Plant was not found")
-			writeErrorResponse(w, 404, "The specified Plant was not found")
+			writeErrorResponse(w, r, 404, problemNotFound, "The specified Plant was not found")
 			return
 		}
-		log.Printf("Error: %v\n", err)
-		writeErrorResponse(w, 500, "An error occurred while processing the request")
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+
+	writeCacheablePlant(w, r, plant)
+}
+
+func (api *Api) getPlantBySlug(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+
+	slug := pathParam(r, "slug")
+	if !slugPattern.MatchString(slug) {
+		log.Printf("Plant slug '%v' is not valid\n", slug)
+		writeErrorResponse(w, r, 400, problemInvalidParameter, "The Plant slug must be lower case letters and digits separated by hyphens")
+		return
+	}
+
+	// Names are unique, but several can share a slug, in which case the
+	// oldest Plant wins
+	ctx, cancel := dbContext(r.Context(), dbOperationRead)
+	defer cancel()
+	plants, _, err := api.DB.GetPlants(ctx, PlantQuery{Filter: PlantFilter{Slug: slug}, Limit: 1})
+	if err != nil {
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	if len(plants) == 0 {
+		log.Println("The specified Plant was not found")
+		writeErrorResponse(w, r, 404, problemNotFound, "The specified Plant was not found")
+		return
+	}
+	writeCacheablePlant(w, r, plants[0])
+}
+
+// writeCacheablePlant writes plant with its ETag, so that clients can
+// revalidate cached copies, or a 304 if the client's copy is current.
+func writeCacheablePlant(w http.ResponseWriter, r *http.Request, plant Plant) {
+	etag := plantETag(plant)
+	w.Header().Set("etag", etag)
+	if etagListMatches(r.Header.Get("if-none-match"), etag, true) {
+		log.Println("The Plant has not been modified")
+		w.WriteHeader(304)
 		return
 	}
-	writeResponse(w, 200, plant)
+	writeResponse(w, r, 200, plant)
 }
 
 func (api *Api) postPlant(w http.ResponseWriter, r *http.Request) {
@@ -53,16 +315,14 @@ func (api *Api) postPlant(w http.ResponseWriter, r *http.Request) {
 
 	// Read body and parse into Plant
 	plantRequest := PlantRequest{}
-	if err := json.NewDecoder(r.Body).Decode(&plantRequest); err != nil {
-		log.Printf("The request body could not be parsed into a Plant: %v", err)
-		writeErrorResponse(w, 400, "The request payload could not be parsed into a Plant")
+	if !readRequestBody(w, r, &plantRequest, "a Plant") {
 		return
 	}
 
 	// Validate the request
-	if validationResults := plantRequest.Validate(); len(validationResults) > 0 {
-		log.Println("The Plant request is invalid: ", strings.Join(validationResults, "; "))
-		writeErrorResponse(w, 400, strings.Join(validationResults, "; "))
+	if fieldErrors := plantRequest.Validate(); len(fieldErrors) > 0 {
+		log.Println("The Plant request is invalid: ", fieldErrorMessages(fieldErrors))
+		writeValidationErrorResponse(w, r, fieldErrors)
 		return
 	}
 
@@ -73,19 +333,207 @@ func (api *Api) postPlant(w http.ResponseWriter, r *http.Request) {
 		Light:      plantRequest.Light,
 		Water:      plantRequest.Water,
 	}
-	if err := api.DB.CreatePlant(newPlant); err != nil {
+	response := CreatePlantResponse{Warnings: api.didYouMeanWarnings(r.Context(), newPlant.Name)}
+	ctx, cancel := dbContext(r.Context(), dbOperationWrite)
+	defer cancel()
+	if err := api.DB.CreatePlant(ctx, newPlant, WriteOptions{Actor: requestActor(r)}); err != nil {
 		var conflictErr *ConflictError
 		if errors.As(err, &conflictErr) {
-			errMsg := fmt.Sprintf("Plant with %v '%v' already exists", conflictErr.ConflictingKey, conflictErr.ConflictingValue)
-			log.Println(errMsg)
-			writeErrorResponse(w, 409, errMsg)
+			writeConflictResponse(w, r, conflictErr)
 			return
 		}
-		log.Printf("Error: %v\n", err)
-		writeErrorResponse(w, 500, "An error occurred while processing the request")
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	writeResponse(w, r, 201, response)
+}
+
+// postPlantBatch creates or upserts many Plants in one request. In the
+// default all-or-nothing mode nothing is written unless every item can be;
+// in best-effort mode each item succeeds or fails on its own.
+func (api *Api) postPlantBatch(w http.ResponseWriter, r *http.Request) {
+	log.Printf("POST %v\n", r.RequestURI)
+
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = batchModeAllOrNothing
+	}
+	if mode != batchModeAllOrNothing && mode != batchModeBestEffort {
+		log.Printf("Batch mode '%v' is not supported", mode)
+		writeErrorResponse(w, r, 400, problemInvalidParameter, fmt.Sprintf("The mode must be %v or %v", batchModeAllOrNothing, batchModeBestEffort))
+		return
+	}
+
+	// Read body and parse into Plants
+	plantRequests := make([]BatchPlantRequest, 0)
+	if !readRequestBody(w, r, &plantRequests, "an array of Plants") {
+		return
+	}
+	if len(plantRequests) == 0 || len(plantRequests) > maxBatchSize {
+		log.Printf("The batch has %v Plants", len(plantRequests))
+		writeErrorResponse(w, r, 400, problemInvalidBody, fmt.Sprintf("The batch must contain between 1 and %v Plants", maxBatchSize))
+		return
+	}
+
+	// Validate every item, so all the problems are reported at once
+	results := make([]BatchItemResult, len(plantRequests))
+	writes := make([]PlantWrite, 0, len(plantRequests))
+	writeIndexes := make([]int, 0, len(plantRequests))
+	for i, plantRequest := range plantRequests {
+		results[i].Index = i
+		if fieldErrors := plantRequest.Validate(); len(fieldErrors) > 0 {
+			results[i].Status = 400
+			results[i].Code = problemValidationFailed
+			results[i].Detail = fieldErrorMessages(fieldErrors)
+			results[i].Errors = fieldErrors
+			continue
+		}
+		writes = append(writes, PlantWrite{Id: plantRequest.Id, Plant: Plant{
+			Name:       plantRequest.Name,
+			OtherNames: plantRequest.OtherNames,
+			Humidity:   plantRequest.Humidity,
+			Light:      plantRequest.Light,
+			Water:      plantRequest.Water,
+		}})
+		writeIndexes = append(writeIndexes, i)
+	}
+
+	allOrNothing := mode == batchModeAllOrNothing
+	if allOrNothing && len(writes) < len(plantRequests) {
+		log.Println("The batch has invalid Plants, so none were written")
+		writes = writes[:0]
+		for _, i := range writeIndexes {
+			results[i] = BatchItemResult{Index: i, Status: 424, Code: problemRolledBack, Detail: "The Plant was not written because another Plant in the batch is invalid"}
+		}
+	}
+	if len(writes) > 0 {
+		ctx, cancel := dbContext(r.Context(), dbOperationBatch)
+		defer cancel()
+		writeResults, err := api.DB.WritePlants(ctx, writes, allOrNothing, WriteOptions{Actor: requestActor(r)})
+		if err != nil {
+			writeDatabaseErrorResponse(w, r, err)
+			return
+		}
+		for j, writeResult := range writeResults {
+			results[writeIndexes[j]] = batchItemResult(writeIndexes[j], writeResult)
+		}
+	}
+
+	writeResponse(w, r, batchStatus(results, allOrNothing), BatchResponse{Mode: mode, Results: results})
+}
+
+// importPlants creates and updates Plants from a CSV file in the body. The
+// dryRun parameter reports what would happen without writing anything.
+func (api *Api) importPlants(w http.ResponseWriter, r *http.Request) {
+	log.Printf("POST %v\n", r.RequestURI)
+
+	opts := ImportOptions{
+		OtherNamesDelimiter: r.URL.Query().Get("delimiter"),
+		Actor:               requestActor(r),
+	}
+	if dryRunStr := r.URL.Query().Get("dryRun"); dryRunStr != "" {
+		dryRun, err := strconv.ParseBool(dryRunStr)
+		if err != nil {
+			log.Printf("dryRun '%v' is not a boolean", dryRunStr)
+			writeErrorResponse(w, r, 400, problemInvalidParameter, "The dryRun parameter must be true or false")
+			return
+		}
+		opts.DryRun = dryRun
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("content-type")); mediaType != csvContentType {
+		log.Printf("Content type '%v' is not supported for imports", mediaType)
+		writeErrorResponse(w, r, 415, problemUnsupportedMediaType, fmt.Sprintf("The content type must be %v", csvContentType))
 		return
 	}
-	writeResponse(w, 201, map[string]string{})
+
+	ctx, cancel := dbContext(r.Context(), dbOperationBatch)
+	defer cancel()
+	report, err := importPlantsCsv(ctx, api.DB, r.Body, opts)
+	if err != nil {
+		var importErr *ImportError
+		if errors.As(err, &importErr) {
+			log.Println(importErr.Message)
+			writeErrorResponse(w, r, 400, problemInvalidBody, importErr.Message)
+			return
+		}
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	writeResponse(w, r, 200, report)
+}
+
+func batchItemResult(index int, writeResult PlantWriteResult) BatchItemResult {
+	var conflictErr *ConflictError
+	var rolledBackErr *RolledBackError
+	switch {
+	case writeResult.Err == nil && writeResult.Created:
+		return BatchItemResult{Index: index, Status: 201, Id: writeResult.Id}
+	case writeResult.Err == nil:
+		return BatchItemResult{Index: index, Status: 200, Id: writeResult.Id}
+	case errors.As(writeResult.Err, &conflictErr):
+		errMsg := fmt.Sprintf("Plant with %v '%v' already exists", conflictErr.ConflictingKey, conflictErr.ConflictingValue)
+		return BatchItemResult{Index: index, Status: 409, Code: problemConflict, Detail: errMsg, Errors: []FieldError{
+			{Field: conflictErr.ConflictingKey, Code: fieldErrorDuplicate, Message: errMsg},
+		}}
+	case errors.As(writeResult.Err, &rolledBackErr):
+		return BatchItemResult{Index: index, Status: 424, Code: problemRolledBack, Detail: "The Plant was not written because another Plant in the batch failed"}
+	default:
+		log.Printf("Error: %v\n", writeResult.Err)
+		return BatchItemResult{Index: index, Status: 500, Code: problemInternalError, Detail: "An error occurred while processing the request"}
+	}
+}
+
+// batchStatus is 200 when every item of a batch succeeded. Otherwise a
+// best-effort batch is 207 Multi-Status and a failed all-or-nothing batch
+// takes the status of its first failed item.
+func batchStatus(results []BatchItemResult, allOrNothing bool) int {
+	for _, result := range results {
+		if result.Status >= 400 && result.Status != 424 {
+			if allOrNothing {
+				return result.Status
+			}
+			return 207
+		}
+	}
+	return 200
+}
+
+// didYouMeanWarnings warns about the existing plant whose name is closest to
+// name, if it's near enough to be a likely misspelling. Only up to
+// maxPageLimit plants starting with the same letter, in either case, are
+// compared, so that creates don't read the whole catalogue. The lookup has
+// its own short deadline, and failing only costs the warning, so a slow or
+// broken lookup never holds up or fails the create.
+func (api *Api) didYouMeanWarnings(ctx context.Context, name string) []string {
+	ctx, cancel := dbContext(ctx, dbOperationWarnings)
+	defer cancel()
+	initial := string([]rune(name)[:1])
+	prefixes := []string{strings.ToUpper(initial)}
+	if lower := strings.ToLower(initial); lower != prefixes[0] {
+		prefixes = append(prefixes, lower)
+	}
+	candidates := make([]Plant, 0)
+	for _, prefix := range prefixes {
+		plants, _, err := api.DB.GetPlants(ctx, PlantQuery{Filter: PlantFilter{NamePrefix: prefix}, Limit: maxPageLimit})
+		if err != nil {
+			log.Printf("Error while looking for similar Plant names: %v\n", err)
+			return nil
+		}
+		candidates = append(candidates, plants...)
+	}
+
+	warnings := make([]string, 0)
+	for _, suggestion := range suggestPlantNames(candidates, name, 1, didYouMeanScore) {
+		if suggestion.MatchedName == name {
+			continue
+		}
+		if suggestion.MatchedName == suggestion.Name {
+			warnings = append(warnings, fmt.Sprintf("Did you mean '%v'?", suggestion.Name))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("Did you mean '%v' (also known as '%v')?", suggestion.Name, suggestion.MatchedName))
+		}
+	}
+	return warnings
 }
 
 func (api *Api) putPlant(w http.ResponseWriter, r *http.Request) {
@@ -93,23 +541,23 @@ func (api *Api) putPlant(w http.ResponseWriter, r *http.Request) {
 
 	// Read body and parse into Plant
 	plantRequest := PlantRequest{}
-	if err := json.NewDecoder(r.Body).Decode(&plantRequest); err != nil {
-		log.Printf("The request body could not be parsed into a Plant: %v", err)
-		writeErrorResponse(w, 400, "The request payload could not be parsed into a Plant")
+	if !readRequestBody(w, r, &plantRequest, "a Plant") {
 		return
 	}
 
-	// Get ID and validate the request
-	idStr := r.FormValue("id")
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		log.Printf("Plant Id '%v' is not an integer", id)
-		writeErrorResponse(w, 400, "The Plant id must be an integer")
+	id, ok := readPlantId(w, r)
+	if !ok {
+		return
+	}
+	if fieldErrors := plantRequest.Validate(); len(fieldErrors) > 0 {
+		log.Println("The Plant request is invalid: ", fieldErrorMessages(fieldErrors))
+		writeValidationErrorResponse(w, r, fieldErrors)
 		return
 	}
-	if validationResults := plantRequest.Validate(); len(validationResults) > 0 {
-		log.Println("The Plant request is invalid: ", strings.Join(validationResults, "; "))
-		writeErrorResponse(w, 400, strings.Join(validationResults, "; "))
+	ctx, cancel := dbContext(r.Context(), dbOperationWrite)
+	defer cancel()
+	writeOptions, ok := api.readIfMatch(ctx, w, r, id)
+	if !ok {
 		return
 	}
 
@@ -121,50 +569,651 @@ func (api *Api) putPlant(w http.ResponseWriter, r *http.Request) {
 		Light:      plantRequest.Light,
 		Water:      plantRequest.Water,
 	}
-	if err = api.DB.UpsertPlant(id, newPlant); err != nil {
+	version, err := api.DB.UpsertPlant(ctx, id, newPlant, writeOptions)
+	if err != nil {
+		if errors.Is(err, &PreconditionFailedError{}) {
+			log.Println("The Plant has been changed since it was retrieved")
+			writeErrorResponse(w, r, 412, problemPreconditionFailed, "The Plant has been changed since it was retrieved")
+			return
+		}
 		var conflictErr *ConflictError
 		if errors.As(err, &conflictErr) {
-			errMsg := fmt.Sprintf("Plant with %v '%v' already exists", conflictErr.ConflictingKey, conflictErr.ConflictingValue)
-			log.Println(errMsg)
-			writeErrorResponse(w, 409, errMsg)
+			writeConflictResponse(w, r, conflictErr)
 			return
 		}
-		log.Printf("Error: %v\n", err)
-		writeErrorResponse(w, 500, "An error occurred while processing the request")
+		writeDatabaseErrorResponse(w, r, err)
 		return
 	}
-	writeResponse(w, 200, map[string]string{})
+	w.Header().Set("etag", versionETag(version))
+	writeResponse(w, r, 200, map[string]string{})
+}
+
+func (api *Api) patchPlant(w http.ResponseWriter, r *http.Request) {
+	log.Printf("PATCH %v\n", r.RequestURI)
+
+	id, ok := readPlantId(w, r)
+	if !ok {
+		return
+	}
+
+	// Read the patch in the format given by its content type
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("content-type"))
+	var patch interface{}
+	switch contentType {
+	case mergePatchContentType:
+		patch = new(interface{})
+	case jsonPatchContentType:
+		patch = &[]JsonPatchOperation{}
+	default:
+		log.Printf("Content type '%v' is not a supported patch format", contentType)
+		writeErrorResponse(w, r, 415, problemUnsupportedMediaType, fmt.Sprintf("The content type must be %v or %v", mergePatchContentType, jsonPatchContentType))
+		return
+	}
+	if err := json.NewDecoder(r.Body).Decode(patch); err != nil {
+		log.Printf("The request body could not be parsed into a patch: %v", err)
+		writeErrorResponse(w, r, 400, problemInvalidBody, "The request payload could not be parsed into a patch")
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationWrite)
+	defer cancel()
+	plant, err := api.DB.GetPlantById(ctx, id)
+	if err != nil {
+		if errors.Is(err, &NotFoundError{}) {
+			log.Println("The specified Plant was not found")
+			writeErrorResponse(w, r, 404, problemNotFound, "The specified Plant was not found")
+			return
+		}
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	writeOptions := WriteOptions{Actor: requestActor(r)}
+	if ifMatch := r.Header.Get("if-match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, plantETag(plant), false) {
+			log.Println("The Plant has been changed since it was retrieved")
+			writeErrorResponse(w, r, 412, problemPreconditionFailed, "The Plant has been changed since it was retrieved")
+			return
+		}
+		writeOptions.IfVersion = plant.Version
+	}
+
+	// Apply the patch to the editable fields of the Plant
+	current := plantToDocument(plant)
+	var patched interface{}
+	switch patch := patch.(type) {
+	case *interface{}:
+		patched = applyMergePatch(plantToDocument(plant), *patch)
+	case *[]JsonPatchOperation:
+		if patched, err = applyJsonPatch(plantToDocument(plant), *patch); err != nil {
+			var testErr *PatchTestFailedError
+			if errors.As(err, &testErr) {
+				log.Println(err)
+				writeErrorResponse(w, r, 409, problemPatchTestFailed, fmt.Sprintf("The JSON Patch test of '%v' failed", testErr.Path))
+				return
+			}
+			log.Printf("The patch could not be applied: %v", err)
+			writeErrorResponse(w, r, 400, problemInvalidPatch, fmt.Sprintf("The patch could not be applied: %v", err))
+			return
+		}
+	}
+
+	// Validate the patched Plant as a whole
+	plantRequest := PlantRequest{}
+	encoded, _ := json.Marshal(patched)
+	decoder := json.NewDecoder(bytes.NewReader(encoded))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&plantRequest); err != nil {
+		log.Printf("The patched Plant could not be parsed: %v", err)
+		writeErrorResponse(w, r, 400, problemInvalidBody, "The patched payload could not be parsed into a Plant")
+		return
+	}
+	if fieldErrors := plantRequest.Validate(); len(fieldErrors) > 0 {
+		log.Println("The patched Plant is invalid: ", fieldErrorMessages(fieldErrors))
+		writeValidationErrorResponse(w, r, fieldErrors)
+		return
+	}
+
+	// Only write the fields which changed
+	changes := make(map[string]interface{})
+	for key, value := range plantRequestToDocument(plantRequest) {
+		if !jsonEqual(value, current[key]) {
+			changes[key] = value
+		}
+	}
+	if len(changes) == 0 {
+		log.Println("The patch doesn't change the Plant")
+		w.Header().Set("etag", plantETag(plant))
+		writeResponse(w, r, 200, map[string]string{})
+		return
+	}
+	version, err := api.DB.PatchPlant(ctx, id, changes, writeOptions)
+	if err != nil {
+		if errors.Is(err, &PreconditionFailedError{}) {
+			log.Println("The Plant has been changed since it was retrieved")
+			writeErrorResponse(w, r, 412, problemPreconditionFailed, "The Plant has been changed since it was retrieved")
+			return
+		}
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) {
+			writeConflictResponse(w, r, conflictErr)
+			return
+		}
+		if errors.Is(err, &NotFoundError{}) {
+			log.Println("The specified Plant was not found")
+			writeErrorResponse(w, r, 404, problemNotFound, "The specified Plant was not found")
+			return
+		}
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("etag", versionETag(version))
+	writeResponse(w, r, 200, map[string]string{})
+}
+
+// plantToDocument returns the fields of plant which can be changed by a
+// patch, as a generic JSON document.
+func plantToDocument(plant Plant) map[string]interface{} {
+	return plantRequestToDocument(PlantRequest{
+		Name:       plant.Name,
+		OtherNames: plant.OtherNames,
+		Humidity:   plant.Humidity,
+		Light:      plant.Light,
+		Water:      plant.Water,
+	})
+}
+
+func plantRequestToDocument(plantRequest PlantRequest) map[string]interface{} {
+	encoded, _ := json.Marshal(plantRequest)
+	document := make(map[string]interface{})
+	json.Unmarshal(encoded, &document)
+	return document
 }
 
 func (api *Api) deletePlant(w http.ResponseWriter, r *http.Request) {
 	log.Printf("DELETE %v\n", r.RequestURI)
 
-	// Retrieve plant ID
-	idStr := r.FormValue("id")
-	id, err := strconv.Atoi(idStr)
+	id, ok := readPlantId(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationWrite)
+	defer cancel()
+	writeOptions, ok := api.readIfMatch(ctx, w, r, id)
+	if !ok {
+		return
+	}
+
+	if err := api.DB.DeletePlant(ctx, id, writeOptions); err != nil {
+		if errors.Is(err, &PreconditionFailedError{}) {
+			log.Println("The Plant has been changed since it was retrieved")
+			writeErrorResponse(w, r, 412, problemPreconditionFailed, "The Plant has been changed since it was retrieved")
+			return
+		}
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	writeResponse(w, r, 204, map[string]string{})
+}
+
+func (api *Api) listTrash(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+
+	ctx, cancel := dbContext(r.Context(), dbOperationRead)
+	defer cancel()
+	plants, err := api.DB.GetDeletedPlants(ctx)
 	if err != nil {
-		log.Printf("Plant Id '%v' is not an integer", id)
-		writeErrorResponse(w, 400, "The Plant id must be an integer")
+		writeDatabaseErrorResponse(w, r, err)
 		return
 	}
+	writeResponse(w, r, 200, plants)
+}
 
-	if err := api.DB.DeletePlant(id); err != nil {
-		log.Printf("Error: %v\n", err)
-		writeErrorResponse(w, 500, "An error occurred while processing the request")
+func (api *Api) restorePlant(w http.ResponseWriter, r *http.Request) {
+	log.Printf("POST %v\n", r.RequestURI)
+
+	id, ok := readPlantId(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationWrite)
+	defer cancel()
+	version, err := api.DB.RestorePlant(ctx, id, WriteOptions{Actor: requestActor(r)})
+	if err != nil {
+		if errors.Is(err, &NotFoundError{}) {
+			log.Println("The specified Plant was not found in the trash")
+			writeErrorResponse(w, r, 404, problemNotFound, "The specified Plant was not found in the trash")
+			return
+		}
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) {
+			writeConflictResponse(w, r, conflictErr)
+			return
+		}
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("etag", versionETag(version))
+	writeResponse(w, r, 200, map[string]string{})
+}
+
+func (api *Api) purgePlant(w http.ResponseWriter, r *http.Request) {
+	log.Printf("DELETE %v\n", r.RequestURI)
+
+	if !isAdmin(r) {
+		log.Println("Purge requested without the admin key")
+		writeErrorResponse(w, r, 403, problemForbidden, "Only administrators can purge Plants")
+		return
+	}
+
+	id, ok := readPlantId(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationWrite)
+	defer cancel()
+	if err := api.DB.PurgePlant(ctx, id); err != nil {
+		if errors.Is(err, &NotFoundError{}) {
+			log.Println("The specified Plant was not found in the trash")
+			writeErrorResponse(w, r, 404, problemNotFound, "The specified Plant was not found in the trash")
+			return
+		}
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	writeResponse(w, r, 204, map[string]string{})
+}
+
+func (api *Api) getPlantHistory(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+
+	id, ok := readPlantId(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationRead)
+	defer cancel()
+	history, err := api.DB.GetPlantHistory(ctx, id)
+	if err != nil {
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	if len(history) == 0 {
+		log.Println("The specified Plant was not found")
+		writeErrorResponse(w, r, 404, problemNotFound, "The specified Plant was not found")
 		return
 	}
-	writeResponse(w, 204, map[string]string{})
+	writeResponse(w, r, 200, history)
 }
 
-func writeResponse(w http.ResponseWriter, httpStatusCode int, responseBody interface{}) {
-	w.Header().Set("content-type", "application/json")
+func (api *Api) getPlantRevision(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+
+	id, revision, ok := readRevisionParams(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationRead)
+	defer cancel()
+	result, err := api.DB.GetPlantRevision(ctx, id, revision)
+	if err != nil {
+		if errors.Is(err, &NotFoundError{}) {
+			log.Println("The specified revision was not found")
+			writeErrorResponse(w, r, 404, problemNotFound, "The specified revision was not found")
+			return
+		}
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	writeResponse(w, r, 200, result)
+}
+
+// revertPlant writes the Plant as it was after the given revision back as
+// a new revision, restoring it if it has since been deleted.
+func (api *Api) revertPlant(w http.ResponseWriter, r *http.Request) {
+	log.Printf("POST %v\n", r.RequestURI)
+
+	id, revision, ok := readRevisionParams(w, r)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := dbContext(r.Context(), dbOperationWrite)
+	defer cancel()
+	target, err := api.DB.GetPlantRevision(ctx, id, revision)
+	if err != nil {
+		if errors.Is(err, &NotFoundError{}) {
+			log.Println("The specified revision was not found")
+			writeErrorResponse(w, r, 404, problemNotFound, "The specified revision was not found")
+			return
+		}
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	if target.After == nil {
+		log.Println("The specified revision has no Plant to revert to")
+		writeErrorResponse(w, r, 400, problemNotRevertible, "The specified revision has no Plant to revert to")
+		return
+	}
+	writeOptions, ok := api.readIfMatch(ctx, w, r, id)
+	if !ok {
+		return
+	}
+
+	reverted := *target.After
+	reverted.DeletedAt = nil
+	version, err := api.DB.UpsertPlant(ctx, id, reverted, writeOptions)
+	if err != nil {
+		if errors.Is(err, &PreconditionFailedError{}) {
+			log.Println("The Plant has been changed since it was retrieved")
+			writeErrorResponse(w, r, 412, problemPreconditionFailed, "The Plant has been changed since it was retrieved")
+			return
+		}
+		var conflictErr *ConflictError
+		if errors.As(err, &conflictErr) {
+			writeConflictResponse(w, r, conflictErr)
+			return
+		}
+		writeDatabaseErrorResponse(w, r, err)
+		return
+	}
+	w.Header().Set("etag", versionETag(version))
+	writeResponse(w, r, 200, map[string]string{})
+}
+
+// readRevisionParams reads the Plant id and revision number of a request,
+// writing a 400 response and returning false if either isn't an integer.
+func readRevisionParams(w http.ResponseWriter, r *http.Request) (int, int, bool) {
+	id, ok := readPlantId(w, r)
+	if !ok {
+		return 0, 0, false
+	}
+	revisionStr := pathParam(r, "rev")
+	revision, err := strconv.Atoi(revisionStr)
+	if err != nil {
+		log.Printf("Revision '%v' is not an integer\n", revisionStr)
+		writeErrorResponse(w, r, 400, problemInvalidParameter, "The revision must be an integer")
+		return 0, 0, false
+	}
+	return id, revision, true
+}
+
+// readPlantId reads the Plant id from the request path, writing a 400
+// response and returning false if it isn't an integer.
+func readPlantId(w http.ResponseWriter, r *http.Request) (int, bool) {
+	idStr := pathParam(r, "id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		log.Printf("Plant Id '%v' is not an integer\n", idStr)
+		writeErrorResponse(w, r, 400, problemInvalidParameter, "The Plant id must be an integer")
+		return 0, false
+	}
+	if id < 1 {
+		log.Printf("Plant Id '%v' is not positive\n", idStr)
+		writeErrorResponse(w, r, 400, problemInvalidParameter, "The Plant id must be a positive integer")
+		return 0, false
+	}
+	return id, true
+}
+
+// slugPattern matches the slugs plantSlug can derive.
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// pathParam reads a variable of the matched route's path template.
+func pathParam(r *http.Request, name string) string {
+	return mux.Vars(r)[name]
+}
+
+// isAdmin reports whether the request carries the admin key from config.
+// Admin requests are refused when no key is configured.
+func isAdmin(r *http.Request) bool {
+	adminKey := viper.GetString("Admin.ApiKey")
+	requestKey := r.Header.Get("x-admin-key")
+	return adminKey != "" && subtle.ConstantTimeCompare([]byte(adminKey), []byte(requestKey)) == 1
+}
+
+// readIfMatch turns the If-Match header of a write into WriteOptions which
+// pin the write to the version of the Plant the client has seen. If the
+// header doesn't match the stored Plant, it writes a 412 response and
+// returns false.
+func (api *Api) readIfMatch(ctx context.Context, w http.ResponseWriter, r *http.Request, id int) (WriteOptions, bool) {
+	ifMatch := r.Header.Get("if-match")
+	if ifMatch == "" {
+		return WriteOptions{Actor: requestActor(r)}, true
+	}
+
+	plant, err := api.DB.GetPlantById(ctx, id)
+	if err != nil && !errors.Is(err, &NotFoundError{}) {
+		writeDatabaseErrorResponse(w, r, err)
+		return WriteOptions{}, false
+	}
+	if err != nil || !etagListMatches(ifMatch, plantETag(plant), false) {
+		log.Println("The Plant has been changed since it was retrieved")
+		writeErrorResponse(w, r, 412, problemPreconditionFailed, "The Plant has been changed since it was retrieved")
+		return WriteOptions{}, false
+	}
+	return WriteOptions{IfVersion: plant.Version, Actor: requestActor(r)}, true
+}
+
+// requestActor identifies who made a request for the history of the Plants
+// it changes: the client's own id if it sent one, otherwise its address.
+func requestActor(r *http.Request) string {
+	if clientId := r.Header.Get("x-client-id"); clientId != "" {
+		return clientId
+	}
+	return r.RemoteAddr
+}
+
+func plantETag(plant Plant) string {
+	return versionETag(plant.Version)
+}
+
+// versionETag is the ETag of a Plant with the given version, which writes
+// return so that clients can make their next write conditional on it.
+func versionETag(version int) string {
+	return fmt.Sprintf("\"%v\"", version)
+}
+
+// etagListMatches reports whether an If-Match or If-None-Match header lists
+// etag or is "*". Weak comparison ignores the W/ prefix, as used by
+// If-None-Match, while strong comparison never matches weak tags.
+func etagListMatches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+var plantQueryParameters = map[string]bool{
+	"limit": true, "offset": true, "sort": true, "name": true, "light": true, "humidity": true, "water": true,
+}
+
+var plantExportParameters = map[string]bool{
+	"format": true, "name": true, "light": true, "humidity": true, "water": true,
+}
+
+// readPlantQuery reads the filter and paging parameters of a listing request.
+// The returned error is suitable for showing to the client.
+func readPlantQuery(r *http.Request) (PlantQuery, error) {
+	params := r.URL.Query()
+	for param := range params {
+		if !plantQueryParameters[param] {
+			return PlantQuery{}, fmt.Errorf("The query parameter '%v' is not supported", param)
+		}
+	}
+
+	// Read paging parameters
+	query := PlantQuery{Limit: defaultPageLimit}
+	if limitStr := params.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return PlantQuery{}, fmt.Errorf("The limit must be an integer between 1 and %v", maxPageLimit)
+		}
+		query.Limit = limit
+	}
+	if offsetStr := params.Get("offset"); offsetStr != "" {
+		offset, err := strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return PlantQuery{}, errors.New("The offset must be a non-negative integer")
+		}
+		query.Offset = offset
+	}
+
+	// Read sort order
+	if sortStr := params.Get("sort"); sortStr != "" {
+		sortFields, err := parseSortFields(sortStr)
+		if err != nil {
+			return PlantQuery{}, err
+		}
+		query.Sort = sortFields
+	}
+
+	filter, err := readPlantFilter(params)
+	if err != nil {
+		return PlantQuery{}, err
+	}
+	query.Filter = filter
+	return query, nil
+}
+
+// readPlantFilter reads the filter parameters shared by listings and exports.
+// A trailing '*' on the name matches by prefix.
+func readPlantFilter(params url.Values) (PlantFilter, error) {
+	filter := PlantFilter{}
+	name := params.Get("name")
+	if strings.HasSuffix(name, "*") {
+		filter.NamePrefix = strings.TrimSuffix(name, "*")
+	} else {
+		filter.Name = name
+	}
+	filter.Light = LightLevel(canonicalLevel(params.Get("light"), lightVocabulary))
+	filter.Humidity = HumidityLevel(canonicalLevel(params.Get("humidity"), humidityVocabulary))
+	filter.Water = WaterLevel(canonicalLevel(params.Get("water"), waterVocabulary))
+	for _, level := range levelFields(filter.Light, filter.Humidity, filter.Water) {
+		if level.value != "" && !level.valid {
+			return PlantFilter{}, errors.New(vocabularyMessage(level.name, level.vocabulary))
+		}
+	}
+	return filter, nil
+}
+
+// pageLink returns the URL of the request with its paging parameters
+// replaced, keeping any other query parameters.
+func pageLink(r *http.Request, limit int, offset int) string {
+	query := r.URL.Query()
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("offset", strconv.Itoa(offset))
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// writeResponse writes responseBody in the format the request's Accept
+// header prefers, falling back to JSON.
+func writeResponse(w http.ResponseWriter, r *http.Request, httpStatusCode int, responseBody interface{}) {
+	codec, _ := responseCodec(r)
+	writeEncoded(w, codec, codec.contentType(), httpStatusCode, responseBody)
+}
+
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, httpStatusCode int, code string, errorMessage string) {
+	writeProblem(w, r, newProblem(httpStatusCode, code, errorMessage))
+}
+
+// writeDatabaseErrorResponse responds to an unexpected error from the
+// database: 504 if it didn't answer before the deadline, 503 if it couldn't be
+// reached and 500 for anything else.
+func writeDatabaseErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case r.Context().Err() != nil && errors.Is(err, context.Canceled):
+		log.Println("The client went away before the request was processed")
+	case isUnavailableError(err):
+		log.Printf("The database is unavailable: %v\n", err)
+		writeErrorResponse(w, r, 503, problemDatabaseUnavailable, "The database is unavailable")
+	case isTimeoutError(err):
+		log.Printf("The database timed out: %v\n", err)
+		writeErrorResponse(w, r, 504, problemDatabaseTimeout, "The database did not respond in time")
+	default:
+		log.Printf("Error: %v\n", err)
+		writeErrorResponse(w, r, 500, problemInternalError, "An error occurred while processing the request")
+	}
+}
+
+// writeValidationErrorResponse responds with a problem listing every invalid
+// field of the request.
+func writeValidationErrorResponse(w http.ResponseWriter, r *http.Request, fieldErrors []FieldError) {
+	problem := newProblem(400, problemValidationFailed, fieldErrorMessages(fieldErrors))
+	problem.Errors = fieldErrors
+	writeProblem(w, r, problem)
+}
+
+func writeConflictResponse(w http.ResponseWriter, r *http.Request, conflictErr *ConflictError) {
+	errMsg := fmt.Sprintf("Plant with %v '%v' already exists", conflictErr.ConflictingKey, conflictErr.ConflictingValue)
+	log.Println(errMsg)
+	problem := newProblem(409, problemConflict, errMsg)
+	problem.Errors = []FieldError{{Field: conflictErr.ConflictingKey, Code: fieldErrorDuplicate, Message: errMsg}}
+	writeProblem(w, r, problem)
+}
+
+func writeProblem(w http.ResponseWriter, r *http.Request, problem ErrorResponse) {
+	codec, _ := responseCodec(r)
+	writeEncoded(w, codec, codec.problemContentType, problem.Status, problem)
+}
+
+func writeEncoded(w http.ResponseWriter, codec codec, contentType string, httpStatusCode int, responseBody interface{}) {
+	w.Header().Set("content-type", contentType)
+	w.Header().Add("vary", "Accept")
 	w.WriteHeader(httpStatusCode)
-	json.NewEncoder(w).Encode(responseBody)
+	if err := codec.encode(w, responseBody); err != nil {
+		log.Printf("Error while encoding the response as %v: %v\n", contentType, err)
+	}
+}
+
+// readRequestBody decodes the request body into v in the format given by
+// its content type, which is named in errors as description. If it can't, it
+// writes the error response and returns false.
+func readRequestBody(w http.ResponseWriter, r *http.Request, v interface{}, description string) bool {
+	codec, ok := requestCodec(r)
+	if !ok {
+		log.Printf("Content type '%v' is not supported\n", r.Header.Get("content-type"))
+		writeErrorResponse(w, r, 415, problemUnsupportedMediaType, fmt.Sprintf("The content type must be one of: %v", supportedMediaTypes()))
+		return false
+	}
+	if err := codec.decode(r.Body, v); err != nil {
+		log.Printf("The request body could not be parsed into %v: %v\n", description, err)
+		writeErrorResponse(w, r, 400, problemInvalidBody, fmt.Sprintf("The request payload could not be parsed into %v", description))
+		return false
+	}
+	return true
+}
+
+// negotiateContent rejects requests whose Accept header allows none of the
+// response formats, before the handler does anything.
+func negotiateContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := responseCodec(r); !ok {
+			log.Printf("None of the media types in '%v' are supported\n", r.Header.Get("accept"))
+			writeErrorResponse(w, r, 406, problemNotAcceptable, fmt.Sprintf("The Accept header must allow one of: %v", supportedMediaTypes()))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
-func writeErrorResponse(w http.ResponseWriter, httpStatusCode int, errorMessage string) {
-	resp := ErrorResponse{
-		Error: errorMessage,
+func fieldErrorMessages(fieldErrors []FieldError) string {
+	messages := make([]string, 0, len(fieldErrors))
+	for _, fieldError := range fieldErrors {
+		messages = append(messages, fieldError.Message)
 	}
-	writeResponse(w, httpStatusCode, resp)
+	return strings.Join(messages, "; ")
 }
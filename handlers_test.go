@@ -1,12 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
-	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type MockDB struct {
@@ -17,6 +29,8 @@ type MockDB struct {
 type TestCase struct {
 	testName             string
 	requestPathId        string
+	requestQuery         string
+	requestHeaders       map[string]string
 	requestBody          string
 	dbResponse           interface{}
 	dbError              error
@@ -24,34 +38,94 @@ type TestCase struct {
 	expectedResponseBody string
 }
 
-func (db *MockDB) Connect() error {
+func (db *MockDB) Connect(ctx context.Context) error {
 	return nil
 }
 
-func (db *MockDB) Disconnect() error {
+func (db *MockDB) Disconnect(ctx context.Context) error {
 	return nil
 }
 
-func (db *MockDB) GetAllPlants() ([]Plant, error) {
-	return db.DbResponse.([]Plant), db.DbError
+func (db *MockDB) Ping(ctx context.Context) error {
+	return db.DbError
+}
+
+func (db *MockDB) GetAllPlants(ctx context.Context) ([]Plant, error) {
+	plants, _ := db.DbResponse.([]Plant)
+	return plants, db.DbError
+}
+
+func (db *MockDB) GetPlants(ctx context.Context, query PlantQuery) ([]Plant, int, error) {
+	stored, _ := db.DbResponse.([]Plant)
+	plants, total := applyPlantQuery(stored, query)
+	return plants, total, db.DbError
+}
+
+func (db *MockDB) StreamPlants(ctx context.Context, filter PlantFilter, fn func(plant Plant) error) error {
+	if db.DbError != nil {
+		return db.DbError
+	}
+	for _, plant := range db.DbResponse.([]Plant) {
+		if filter.Matches(plant) {
+			if err := fn(plant); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
-func (db *MockDB) GetPlantById(id int) (Plant, error) {
+func (db *MockDB) GetPlantById(ctx context.Context, id int) (Plant, error) {
 	return db.DbResponse.(Plant), db.DbError
 }
 
-func (db *MockDB) CreatePlant(plant Plant) error {
+func (db *MockDB) SearchPlants(ctx context.Context, text string, limit int) ([]PlantSearchResult, error) {
+	return db.DbResponse.([]PlantSearchResult), db.DbError
+}
+
+func (db *MockDB) CreatePlant(ctx context.Context, plant Plant, opts WriteOptions) error {
 	return db.DbError
 }
 
-func (db *MockDB) UpsertPlant(id int, plant Plant) error {
+func (db *MockDB) UpsertPlant(ctx context.Context, id int, plant Plant, opts WriteOptions) (int, error) {
+	stored, _ := db.DbResponse.(Plant)
+	return stored.Version + 1, db.DbError
+}
+
+func (db *MockDB) WritePlants(ctx context.Context, writes []PlantWrite, allOrNothing bool, opts WriteOptions) ([]PlantWriteResult, error) {
+	return db.DbResponse.([]PlantWriteResult), db.DbError
+}
+
+func (db *MockDB) PatchPlant(ctx context.Context, id int, changes map[string]interface{}, opts WriteOptions) (int, error) {
+	stored, _ := db.DbResponse.(Plant)
+	return stored.Version + 1, db.DbError
+}
+
+func (db *MockDB) DeletePlant(ctx context.Context, id int, opts WriteOptions) error {
 	return db.DbError
 }
 
-func (db *MockDB) DeletePlant(id int) error {
+func (db *MockDB) GetDeletedPlants(ctx context.Context) ([]Plant, error) {
+	return db.DbResponse.([]Plant), db.DbError
+}
+
+func (db *MockDB) RestorePlant(ctx context.Context, id int, opts WriteOptions) (int, error) {
+	stored, _ := db.DbResponse.(Plant)
+	return stored.Version + 1, db.DbError
+}
+
+func (db *MockDB) PurgePlant(ctx context.Context, id int) error {
 	return db.DbError
 }
 
+func (db *MockDB) GetPlantHistory(ctx context.Context, id int) ([]PlantRevision, error) {
+	return db.DbResponse.([]PlantRevision), db.DbError
+}
+
+func (db *MockDB) GetPlantRevision(ctx context.Context, id int, revision int) (PlantRevision, error) {
+	return db.DbResponse.(PlantRevision), db.DbError
+}
+
 func TestListPlants(t *testing.T) {
 	cases := []TestCase{
 		{
@@ -68,14 +142,81 @@ func TestListPlants(t *testing.T) {
 			},
 			dbError:              nil,
 			expectedStatusCode:   200,
-			expectedResponseBody: "[{\"id\":99,\"name\":\"Plant A\",\"otherNames\":[\"Other name A\"],\"light\":\"low\",\"humidity\":\"high\",\"water\":\"low\"}]",
+			expectedResponseBody: "{\"items\":[{\"id\":99,\"name\":\"Plant A\",\"otherNames\":[\"Other name A\"],\"light\":\"low\",\"humidity\":\"high\",\"water\":\"low\"}],\"total\":1,\"limit\":20,\"offset\":0,\"links\":{}}",
+		},
+		{
+			testName:             "paged_db_response_returns_200_and_links",
+			requestQuery:         "limit=1&offset=1",
+			dbResponse:           []Plant{{Id: 1, Name: "Plant A"}, {Id: 2, Name: "Plant B"}, {Id: 3, Name: "Plant C"}},
+			dbError:              nil,
+			expectedStatusCode:   200,
+			expectedResponseBody: "{\"items\":[{\"id\":2,\"name\":\"Plant B\",\"otherNames\":null,\"light\":\"\",\"humidity\":\"\",\"water\":\"\"}],\"total\":3,\"limit\":1,\"offset\":1,\"links\":{\"next\":\"api/plants?limit=1\\u0026offset=2\",\"prev\":\"api/plants?limit=1\\u0026offset=0\"}}",
 		},
 		{
 			testName:             "error_db_response_returns_500_and_error",
 			dbResponse:           []Plant{},
 			dbError:              errors.New("something went wrong!"),
 			expectedStatusCode:   500,
-			expectedResponseBody: "{\"error\":\"An error occurred while processing the request\"}",
+			expectedResponseBody: "{\"type\":\"/problems/internal-error\",\"title\":\"Internal error\",\"status\":500,\"detail\":\"An error occurred while processing the request\",\"code\":\"internal-error\"}",
+		},
+		{
+			testName:             "invalid_limit_returns_400_and_error",
+			requestQuery:         "limit=0",
+			dbResponse:           []Plant{},
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The limit must be an integer between 1 and 100\",\"code\":\"invalid-parameter\"}",
+		},
+		{
+			testName:             "filtered_db_response_returns_200_and_matching_plants",
+			requestQuery:         "name=Plant*&light=low",
+			dbResponse:           []Plant{{Id: 1, Name: "Plant A", Light: "low"}, {Id: 2, Name: "Plant B", Light: "high"}, {Id: 3, Name: "Other", Light: "low"}},
+			dbError:              nil,
+			expectedStatusCode:   200,
+			expectedResponseBody: "{\"items\":[{\"id\":1,\"name\":\"Plant A\",\"otherNames\":null,\"light\":\"low\",\"humidity\":\"\",\"water\":\"\"}],\"total\":1,\"limit\":20,\"offset\":0,\"links\":{}}",
+		},
+		{
+			testName:             "sorted_db_response_returns_200_and_sorted_plants",
+			requestQuery:         "sort=-name&limit=2",
+			dbResponse:           []Plant{{Id: 1, Name: "Plant A"}, {Id: 2, Name: "Plant C"}, {Id: 3, Name: "Plant B"}},
+			dbError:              nil,
+			expectedStatusCode:   200,
+			expectedResponseBody: "{\"items\":[{\"id\":2,\"name\":\"Plant C\",\"otherNames\":null,\"light\":\"\",\"humidity\":\"\",\"water\":\"\"},{\"id\":3,\"name\":\"Plant B\",\"otherNames\":null,\"light\":\"\",\"humidity\":\"\",\"water\":\"\"}],\"total\":3,\"limit\":2,\"offset\":0,\"links\":{\"next\":\"api/plants?limit=2\\u0026offset=2\\u0026sort=-name\"}}",
+		},
+		{
+			testName:             "unsortable_field_returns_400_and_error",
+			requestQuery:         "sort=name,otherNames",
+			dbResponse:           []Plant{},
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"Plants can't be sorted by 'otherNames'\",\"code\":\"invalid-parameter\"}",
+		},
+		{
+			testName:             "filter_levels_are_case_insensitive",
+			requestQuery:         "light=Bright%20Indirect",
+			dbResponse:           []Plant{{Id: 1, Name: "Plant A", Light: "bright indirect"}, {Id: 2, Name: "Plant B", Light: "low"}},
+			dbError:              nil,
+			expectedStatusCode:   200,
+			expectedResponseBody: "{\"items\":[{\"id\":1,\"name\":\"Plant A\",\"otherNames\":null,\"light\":\"bright indirect\",\"humidity\":\"\",\"water\":\"\"}],\"total\":1,\"limit\":20,\"offset\":0,\"links\":{}}",
+		},
+		{
+			testName:             "invalid_filter_level_returns_400_and_error",
+			requestQuery:         "water=lots",
+			dbResponse:           []Plant{},
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The water value must be one of: low, moderate, high\",\"code\":\"invalid-parameter\"}",
+		},
+		{
+			testName:             "unknown_parameter_returns_400_and_error",
+			requestQuery:         "colour=green",
+			dbResponse:           []Plant{},
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The query parameter 'colour' is not supported\",\"code\":\"invalid-parameter\"}",
+		},
+		{
+			testName:             "invalid_offset_returns_400_and_error",
+			requestQuery:         "offset=abc",
+			dbResponse:           []Plant{},
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The offset must be a non-negative integer\",\"code\":\"invalid-parameter\"}",
 		},
 	}
 
@@ -83,12 +224,13 @@ func TestListPlants(t *testing.T) {
 		t.Run(tc.testName, func(t *testing.T) {
 			// Arrange
 			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
-			req := http.Request{RequestURI: "api/plants"}
+			req, _ := http.NewRequest("GET", "api/plants", nil)
+			req.URL.RawQuery = tc.requestQuery
 			w := httptest.NewRecorder()
 			api := Api{DB: db}
 
 			// Act
-			api.listPlants(w, &req)
+			api.listPlants(w, req)
 
 			// Assert
 			responseBody := strings.TrimSpace(w.Body.String())
@@ -105,46 +247,51 @@ func TestListPlants(t *testing.T) {
 	}
 }
 
-func TestGetPlant(t *testing.T) {
+func TestGetVocabulary(t *testing.T) {
+	// Arrange
+	req, _ := http.NewRequest("GET", "api/vocabulary", nil)
+	w := httptest.NewRecorder()
+	api := Api{DB: &MockDB{}}
+
+	// Act
+	api.getVocabulary(w, req)
+
+	// Assert
+	expectedResponseBody := "{\"light\":[\"low\",\"medium\",\"bright indirect\",\"bright direct\"],\"humidity\":[\"low\",\"moderate\",\"high\"],\"water\":[\"low\",\"moderate\",\"high\"]}"
+	if responseBody := strings.TrimSpace(w.Body.String()); responseBody != expectedResponseBody {
+		t.Errorf("handler returned unexpected body: got %v, want %v", responseBody, expectedResponseBody)
+	}
+	if w.Result().StatusCode != 200 {
+		t.Errorf("handler returned unexpected status code: got %v, want 200", w.Result().StatusCode)
+	}
+}
+
+func TestSearchPlants(t *testing.T) {
 	cases := []TestCase{
 		{
-			testName:      "valid_db_response_returns_200_and_plant",
-			requestPathId: "99",
-			dbResponse: Plant{
-				Id:         99,
-				Name:       "Plant A",
-				OtherNames: []string{"Other name A"},
-				Light:      "low",
-				Humidity:   "high",
-				Water:      "low",
+			testName:     "valid_db_response_returns_200_and_ranked_plants",
+			requestQuery: "q=dragon+tree",
+			dbResponse: []PlantSearchResult{
+				{Plant: Plant{Id: 1, Name: "Dracaena Marginata", OtherNames: []string{"Dragon Tree"}}, Score: 2},
 			},
 			dbError:              nil,
 			expectedStatusCode:   200,
-			expectedResponseBody: "{\"id\":99,\"name\":\"Plant A\",\"otherNames\":[\"Other name A\"],\"light\":\"low\",\"humidity\":\"high\",\"water\":\"low\"}",
+			expectedResponseBody: "[{\"id\":1,\"name\":\"Dracaena Marginata\",\"otherNames\":[\"Dragon Tree\"],\"light\":\"\",\"humidity\":\"\",\"water\":\"\",\"score\":2}]",
 		},
 		{
 			testName:             "error_db_response_returns_500_and_error",
-			requestPathId:        "99",
-			dbResponse:           Plant{},
+			requestQuery:         "q=dragon",
+			dbResponse:           []PlantSearchResult{},
 			dbError:              errors.New("something went wrong!"),
 			expectedStatusCode:   500,
-			expectedResponseBody: "{\"error\":\"An error occurred while processing the request\"}",
-		},
-		{
-			testName:             "notfound_db_response_returns_404_and_error",
-			requestPathId:        "99",
-			dbResponse:           Plant{},
-			dbError:              &NotFoundError{},
-			expectedStatusCode:   404,
-			expectedResponseBody: "{\"error\":\"The specified Plant was not found\"}",
+			expectedResponseBody: "{\"type\":\"/problems/internal-error\",\"title\":\"Internal error\",\"status\":500,\"detail\":\"An error occurred while processing the request\",\"code\":\"internal-error\"}",
 		},
 		{
-			testName:             "invalid_id_returns_400_and_error",
-			requestPathId:        "abc",
-			dbResponse:           []Plant{},
-			dbError:              nil,
+			testName:             "missing_text_returns_400_and_error",
+			requestQuery:         "q=+",
+			dbResponse:           []PlantSearchResult{},
 			expectedStatusCode:   400,
-			expectedResponseBody: "{\"error\":\"The Plant id must be an integer\"}",
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The q parameter is required\",\"code\":\"invalid-parameter\"}",
 		},
 	}
 
@@ -152,15 +299,13 @@ func TestGetPlant(t *testing.T) {
 		t.Run(tc.testName, func(t *testing.T) {
 			// Arrange
 			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
-			req, _ := http.NewRequest("GET", "api/plants", nil)
-			query := url.Values{}
-			query.Add("id", tc.requestPathId)
-			req.URL.RawQuery = query.Encode()
+			req, _ := http.NewRequest("GET", "api/plants/search", nil)
+			req.URL.RawQuery = tc.requestQuery
 			w := httptest.NewRecorder()
 			api := Api{DB: db}
 
 			// Act
-			api.getPlant(w, req)
+			api.searchPlants(w, req)
 
 			// Assert
 			responseBody := strings.TrimSpace(w.Body.String())
@@ -177,40 +322,83 @@ func TestGetPlant(t *testing.T) {
 	}
 }
 
-func TestPostPlant(t *testing.T) {
-	cases := []TestCase{
+func TestExportPlants(t *testing.T) {
+	plants := []Plant{
+		{Id: 1, Name: "Dracaena Marginata", OtherNames: []string{"Dragon Tree", "Red Edge"}, Light: "low", Humidity: "low", Water: "low"},
+		{Id: 2, Name: "Ficus Elastica", OtherNames: []string{}, Light: "bright indirect", Humidity: "moderate", Water: "moderate"},
+	}
+	cases := []struct {
+		TestCase
+		expectedContentType string
+	}{
 		{
-			testName:             "valid_db_response_returns_201",
-			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
-			dbError:              nil,
-			expectedStatusCode:   201,
-			expectedResponseBody: "{}",
+			TestCase: TestCase{
+				testName:             "default_format_returns_200_and_json_array",
+				dbResponse:           plants,
+				expectedStatusCode:   200,
+				expectedResponseBody: "[{\"id\":1,\"name\":\"Dracaena Marginata\",\"otherNames\":[\"Dragon Tree\",\"Red Edge\"],\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"}\n,{\"id\":2,\"name\":\"Ficus Elastica\",\"otherNames\":[],\"light\":\"bright indirect\",\"humidity\":\"moderate\",\"water\":\"moderate\"}\n]",
+			},
+			expectedContentType: "application/json",
 		},
 		{
-			testName:             "error_db_response_returns_500_and_error",
-			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
-			dbError:              errors.New("something went wrong!"),
-			expectedStatusCode:   500,
-			expectedResponseBody: "{\"error\":\"An error occurred while processing the request\"}",
+			TestCase: TestCase{
+				testName:             "ndjson_format_returns_200_and_a_plant_per_line",
+				requestQuery:         "format=ndjson&light=low",
+				dbResponse:           plants,
+				expectedStatusCode:   200,
+				expectedResponseBody: "{\"id\":1,\"name\":\"Dracaena Marginata\",\"otherNames\":[\"Dragon Tree\",\"Red Edge\"],\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"}",
+			},
+			expectedContentType: "application/x-ndjson",
 		},
 		{
-			testName:             "conflict_db_response_returns_409_and_error",
-			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
-			dbError:              &ConflictError{ConflictingKey: "name", ConflictingValue: "plant X"},
-			expectedStatusCode:   409,
-			expectedResponseBody: "{\"error\":\"Plant with name 'plant X' already exists\"}",
+			TestCase: TestCase{
+				testName:             "csv_format_returns_200_and_importable_csv",
+				requestQuery:         "format=csv",
+				dbResponse:           plants,
+				expectedStatusCode:   200,
+				expectedResponseBody: "id,name,otherNames,light,humidity,water\n1,Dracaena Marginata,Dragon Tree;Red Edge,low,low,low\n2,Ficus Elastica,,bright indirect,moderate,moderate",
+			},
+			expectedContentType: "text/csv",
 		},
 		{
-			testName:             "invalid_payload_returns_400_and_error",
-			requestBody:          "{\"name\":123,\"invalid\":\"plant\"}",
-			expectedStatusCode:   400,
-			expectedResponseBody: "{\"error\":\"The request payload could not be parsed into a Plant\"}",
+			TestCase: TestCase{
+				testName:             "no_matching_plants_returns_200_and_empty_json_array",
+				requestQuery:         "name=cactus",
+				dbResponse:           plants,
+				expectedStatusCode:   200,
+				expectedResponseBody: "[]",
+			},
+			expectedContentType: "application/json",
 		},
 		{
-			testName:             "failed_validation_returns_400_and_error",
-			requestBody:          "{\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
-			expectedStatusCode:   400,
-			expectedResponseBody: "{\"error\":\"The name value is required\"}",
+			TestCase: TestCase{
+				testName:             "invalid_format_returns_400_and_error",
+				requestQuery:         "format=xlsx",
+				dbResponse:           plants,
+				expectedStatusCode:   400,
+				expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The format must be csv, ndjson or json\",\"code\":\"invalid-parameter\"}",
+			},
+			expectedContentType: "application/problem+json",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "unsupported_parameter_returns_400_and_error",
+				requestQuery:         "sort=name",
+				dbResponse:           plants,
+				expectedStatusCode:   400,
+				expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The query parameter 'sort' is not supported\",\"code\":\"invalid-parameter\"}",
+			},
+			expectedContentType: "application/problem+json",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "error_db_response_returns_500_and_error",
+				dbResponse:           plants,
+				dbError:              errors.New("something went wrong!"),
+				expectedStatusCode:   500,
+				expectedResponseBody: "{\"type\":\"/problems/internal-error\",\"title\":\"Internal error\",\"status\":500,\"detail\":\"An error occurred while processing the request\",\"code\":\"internal-error\"}",
+			},
+			expectedContentType: "application/problem+json",
 		},
 	}
 
@@ -218,12 +406,13 @@ func TestPostPlant(t *testing.T) {
 		t.Run(tc.testName, func(t *testing.T) {
 			// Arrange
 			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
-			req, _ := http.NewRequest("POST", "api/plants", strings.NewReader(tc.requestBody))
+			req, _ := http.NewRequest("GET", "api/plants/export", nil)
+			req.URL.RawQuery = tc.requestQuery
 			w := httptest.NewRecorder()
 			api := Api{DB: db}
 
 			// Act
-			api.postPlant(w, req)
+			api.exportPlants(w, req)
 
 			// Assert
 			responseBody := strings.TrimSpace(w.Body.String())
@@ -236,56 +425,37 @@ func TestPostPlant(t *testing.T) {
 				t.Errorf("handler returned unexpected status code: got %v, want %v",
 					actualStatusCode, tc.expectedStatusCode)
 			}
+			if contentType := w.Header().Get("content-type"); contentType != tc.expectedContentType {
+				t.Errorf("handler returned unexpected content type: got %v, want %v",
+					contentType, tc.expectedContentType)
+			}
 		})
 	}
 }
 
-func TestPutPlant(t *testing.T) {
+func TestSuggestPlants(t *testing.T) {
 	cases := []TestCase{
 		{
-			testName:             "valid_db_response_returns_200",
-			requestPathId:        "99",
-			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			testName:             "misspelt_name_returns_200_and_closest_names",
+			requestQuery:         "name=dragon+trea",
+			dbResponse:           []Plant{{Id: 1, Name: "Dracaena Marginata", OtherNames: []string{"Dragon Tree"}}, {Id: 2, Name: "Ficus Elastica"}},
 			dbError:              nil,
 			expectedStatusCode:   200,
-			expectedResponseBody: "{}",
+			expectedResponseBody: "[{\"id\":1,\"name\":\"Dracaena Marginata\",\"matchedName\":\"Dragon Tree\",\"score\":0.9090909090909091}]",
 		},
 		{
 			testName:             "error_db_response_returns_500_and_error",
-			requestPathId:        "99",
-			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			requestQuery:         "name=dragon",
+			dbResponse:           []Plant{},
 			dbError:              errors.New("something went wrong!"),
 			expectedStatusCode:   500,
-			expectedResponseBody: "{\"error\":\"An error occurred while processing the request\"}",
-		},
-		{
-			testName:             "conflict_db_response_returns_409_and_error",
-			requestPathId:        "99",
-			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
-			dbError:              &ConflictError{ConflictingKey: "name", ConflictingValue: "plant X"},
-			expectedStatusCode:   409,
-			expectedResponseBody: "{\"error\":\"Plant with name 'plant X' already exists\"}",
-		},
-		{
-			testName:             "invalid_payload_returns_400_and_error",
-			requestPathId:        "99",
-			requestBody:          "{\"name\":123,\"invalid\":\"plant\"}",
-			expectedStatusCode:   400,
-			expectedResponseBody: "{\"error\":\"The request payload could not be parsed into a Plant\"}",
-		},
-		{
-			testName:             "invalid_id_returns_400_and_error",
-			requestPathId:        "abc",
-			requestBody:          "{\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
-			expectedStatusCode:   400,
-			expectedResponseBody: "{\"error\":\"The Plant id must be an integer\"}",
+			expectedResponseBody: "{\"type\":\"/problems/internal-error\",\"title\":\"Internal error\",\"status\":500,\"detail\":\"An error occurred while processing the request\",\"code\":\"internal-error\"}",
 		},
 		{
-			testName:             "failed_validation_returns_400_and_error",
-			requestPathId:        "99",
-			requestBody:          "{\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			testName:             "missing_name_returns_400_and_error",
+			dbResponse:           []Plant{},
 			expectedStatusCode:   400,
-			expectedResponseBody: "{\"error\":\"The name value is required\"}",
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The name parameter is required\",\"code\":\"invalid-parameter\"}",
 		},
 	}
 
@@ -293,15 +463,13 @@ func TestPutPlant(t *testing.T) {
 		t.Run(tc.testName, func(t *testing.T) {
 			// Arrange
 			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
-			req, _ := http.NewRequest("PUT", "api/plants", strings.NewReader(tc.requestBody))
-			query := url.Values{}
-			query.Add("id", tc.requestPathId)
-			req.URL.RawQuery = query.Encode()
+			req, _ := http.NewRequest("GET", "api/plants/suggest", nil)
+			req.URL.RawQuery = tc.requestQuery
 			w := httptest.NewRecorder()
 			api := Api{DB: db}
 
 			// Act
-			api.putPlant(w, req)
+			api.suggestPlants(w, req)
 
 			// Assert
 			responseBody := strings.TrimSpace(w.Body.String())
@@ -318,27 +486,71 @@ func TestPutPlant(t *testing.T) {
 	}
 }
 
-func TestDeletePlant(t *testing.T) {
+func TestGetPlant(t *testing.T) {
 	cases := []TestCase{
 		{
-			testName:             "valid_db_response_returns_204",
-			requestPathId:        "99",
+			testName:      "valid_db_response_returns_200_and_plant",
+			requestPathId: "99",
+			dbResponse: Plant{
+				Id:         99,
+				Name:       "Plant A",
+				OtherNames: []string{"Other name A"},
+				Light:      "low",
+				Humidity:   "high",
+				Water:      "low",
+			},
 			dbError:              nil,
-			expectedStatusCode:   204,
-			expectedResponseBody: "{}",
+			expectedStatusCode:   200,
+			expectedResponseBody: "{\"id\":99,\"name\":\"Plant A\",\"otherNames\":[\"Other name A\"],\"light\":\"low\",\"humidity\":\"high\",\"water\":\"low\"}",
 		},
 		{
 			testName:             "error_db_response_returns_500_and_error",
 			requestPathId:        "99",
+			dbResponse:           Plant{},
 			dbError:              errors.New("something went wrong!"),
 			expectedStatusCode:   500,
-			expectedResponseBody: "{\"error\":\"An error occurred while processing the request\"}",
+			expectedResponseBody: "{\"type\":\"/problems/internal-error\",\"title\":\"Internal error\",\"status\":500,\"detail\":\"An error occurred while processing the request\",\"code\":\"internal-error\"}",
+		},
+		{
+			testName:             "timed_out_db_response_returns_504_and_error",
+			requestPathId:        "99",
+			dbResponse:           Plant{},
+			dbError:              fmt.Errorf("MongoDB findOne failed: %w", context.DeadlineExceeded),
+			expectedStatusCode:   504,
+			expectedResponseBody: "{\"type\":\"/problems/database-timeout\",\"title\":\"Database timeout\",\"status\":504,\"detail\":\"The database did not respond in time\",\"code\":\"database-timeout\"}",
+		},
+		{
+			testName:             "unreachable_db_response_returns_503_and_error",
+			requestPathId:        "99",
+			dbResponse:           Plant{},
+			dbError:              fmt.Errorf("MongoDB findOne failed: %w", mongo.CommandError{Labels: []string{"NetworkError"}}),
+			expectedStatusCode:   503,
+			expectedResponseBody: "{\"type\":\"/problems/database-unavailable\",\"title\":\"Database unavailable\",\"status\":503,\"detail\":\"The database is unavailable\",\"code\":\"database-unavailable\"}",
+		},
+		{
+			testName:             "matching_if_none_match_returns_304",
+			requestPathId:        "99",
+			requestHeaders:       map[string]string{"If-None-Match": "W/\"3\""},
+			dbResponse:           Plant{Id: 99, Name: "Plant A", Version: 3},
+			dbError:              nil,
+			expectedStatusCode:   304,
+			expectedResponseBody: "",
+		},
+		{
+			testName:             "notfound_db_response_returns_404_and_error",
+			requestPathId:        "99",
+			dbResponse:           Plant{},
+			dbError:              &NotFoundError{},
+			expectedStatusCode:   404,
+			expectedResponseBody: "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified Plant was not found\",\"code\":\"not-found\"}",
 		},
 		{
 			testName:             "invalid_id_returns_400_and_error",
 			requestPathId:        "abc",
+			dbResponse:           []Plant{},
+			dbError:              nil,
 			expectedStatusCode:   400,
-			expectedResponseBody: "{\"error\":\"The Plant id must be an integer\"}",
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The Plant id must be an integer\",\"code\":\"invalid-parameter\"}",
 		},
 	}
 
@@ -346,15 +558,16 @@ func TestDeletePlant(t *testing.T) {
 		t.Run(tc.testName, func(t *testing.T) {
 			// Arrange
 			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
-			req, _ := http.NewRequest("PUT", "api/plants", nil)
-			query := url.Values{}
-			query.Add("id", tc.requestPathId)
-			req.URL.RawQuery = query.Encode()
+			req, _ := http.NewRequest("GET", "api/plants", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tc.requestPathId})
+			for header, value := range tc.requestHeaders {
+				req.Header.Set(header, value)
+			}
 			w := httptest.NewRecorder()
 			api := Api{DB: db}
 
 			// Act
-			api.deletePlant(w, req)
+			api.getPlant(w, req)
 
 			// Assert
 			responseBody := strings.TrimSpace(w.Body.String())
@@ -370,3 +583,1262 @@ func TestDeletePlant(t *testing.T) {
 		})
 	}
 }
+
+func TestPostPlant(t *testing.T) {
+	cases := []TestCase{
+		{
+			testName:             "valid_db_response_returns_201",
+			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			dbError:              nil,
+			expectedStatusCode:   201,
+			expectedResponseBody: "{}",
+		},
+		{
+			testName:             "similar_name_returns_201_and_warning",
+			requestBody:          "{\"name\":\"Dracena marginatta\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			dbResponse:           []Plant{{Id: 1, Name: "Dracaena Marginata"}, {Id: 2, Name: "Ficus Elastica"}},
+			dbError:              nil,
+			expectedStatusCode:   201,
+			expectedResponseBody: "{\"warnings\":[\"Did you mean 'Dracaena Marginata'?\"]}",
+		},
+		{
+			testName:             "several_similar_names_return_201_and_closest_warning",
+			requestBody:          "{\"name\":\"dracaena marginatta\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			dbResponse:           []Plant{{Id: 1, Name: "Dracaena Marginatum"}, {Id: 2, Name: "Dracaena Marginata"}, {Id: 3, Name: "Ficus Elastica"}},
+			dbError:              nil,
+			expectedStatusCode:   201,
+			expectedResponseBody: "{\"warnings\":[\"Did you mean 'Dracaena Marginata'?\"]}",
+		},
+		{
+			testName:             "unknown_field_returns_400_and_error",
+			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"colour\":\"green\"}",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-body\",\"title\":\"Invalid request body\",\"status\":400,\"detail\":\"The request payload could not be parsed into a Plant\",\"code\":\"invalid-body\"}",
+		},
+		{
+			testName:             "error_db_response_returns_500_and_error",
+			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			dbError:              errors.New("something went wrong!"),
+			expectedStatusCode:   500,
+			expectedResponseBody: "{\"type\":\"/problems/internal-error\",\"title\":\"Internal error\",\"status\":500,\"detail\":\"An error occurred while processing the request\",\"code\":\"internal-error\"}",
+		},
+		{
+			testName:             "conflict_db_response_returns_409_and_error",
+			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			dbError:              &ConflictError{ConflictingKey: "name", ConflictingValue: "plant X"},
+			expectedStatusCode:   409,
+			expectedResponseBody: "{\"type\":\"/problems/conflict\",\"title\":\"Conflict\",\"status\":409,\"detail\":\"Plant with name 'plant X' already exists\",\"code\":\"conflict\",\"errors\":[{\"field\":\"name\",\"code\":\"duplicate\",\"message\":\"Plant with name 'plant X' already exists\"}]}",
+		},
+		{
+			testName:             "invalid_payload_returns_400_and_error",
+			requestBody:          "{\"name\":123,\"invalid\":\"plant\"}",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-body\",\"title\":\"Invalid request body\",\"status\":400,\"detail\":\"The request payload could not be parsed into a Plant\",\"code\":\"invalid-body\"}",
+		},
+		{
+			testName:             "failed_validation_returns_400_and_error",
+			requestBody:          "{\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/validation-failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"The name value is required\",\"code\":\"validation-failed\",\"errors\":[{\"field\":\"name\",\"code\":\"required\",\"message\":\"The name value is required\"}]}",
+		},
+		{
+			testName:             "invalid_level_returns_400_and_error",
+			requestBody:          "{\"name\":\"plant A\",\"light\":\"LOW\",\"humidity\":\"hi\",\"water\":\"low\",\"otherNames\":[]}",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/validation-failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"The humidity value must be one of: low, moderate, high\",\"code\":\"validation-failed\",\"errors\":[{\"field\":\"humidity\",\"code\":\"invalid-value\",\"message\":\"The humidity value must be one of: low, moderate, high\"}]}",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
+			req, _ := http.NewRequest("POST", "api/plants", strings.NewReader(tc.requestBody))
+			w := httptest.NewRecorder()
+			api := Api{DB: db}
+
+			// Act
+			api.postPlant(w, req)
+
+			// Assert
+			responseBody := strings.TrimSpace(w.Body.String())
+			if responseBody != tc.expectedResponseBody {
+				t.Errorf("handler returned unexpected body: got %v, want %v",
+					responseBody, tc.expectedResponseBody)
+			}
+			actualStatusCode := w.Result().StatusCode
+			if actualStatusCode != tc.expectedStatusCode {
+				t.Errorf("handler returned unexpected status code: got %v, want %v",
+					actualStatusCode, tc.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestErrorResponsesAreProblemDetails(t *testing.T) {
+	// Arrange
+	db := &MockDB{}
+	req, _ := http.NewRequest("POST", "api/plants", strings.NewReader("{\"light\":\"low\"}"))
+	w := httptest.NewRecorder()
+	api := Api{DB: db}
+
+	// Act
+	api.postPlant(w, req)
+
+	// Assert
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/problem+json" {
+		t.Errorf("handler returned unexpected content type: got %v, want application/problem+json", contentType)
+	}
+	var problem ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("handler returned unparseable body: %v", w.Body.String())
+	}
+	if problem.Status != 400 || problem.Code != "validation-failed" || problem.Type != "/problems/validation-failed" {
+		t.Errorf("handler returned unexpected problem: %+v", problem)
+	}
+	fields := make([]string, 0)
+	for _, fieldError := range problem.Errors {
+		fields = append(fields, fieldError.Field+":"+fieldError.Code)
+	}
+	if strings.Join(fields, ",") != "name:required,humidity:required,water:required" {
+		t.Errorf("handler returned unexpected field errors: %v", fields)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	plant := Plant{Id: 1, Name: "Dracaena Marginata", OtherNames: []string{"Dragon Tree"}, Light: "low", Humidity: "low", Water: "low"}
+	cases := []struct {
+		TestCase
+		method              string
+		expectedContentType string
+	}{
+		{
+			TestCase: TestCase{
+				testName:             "xml_accept_returns_xml",
+				requestHeaders:       map[string]string{"Accept": "application/xml"},
+				dbResponse:           plant,
+				expectedStatusCode:   200,
+				expectedResponseBody: "<plant><id>1</id><name>Dracaena Marginata</name><otherNames><otherName>Dragon Tree</otherName></otherNames><light>low</light><humidity>low</humidity><water>low</water></plant>",
+			},
+			method:              "GET",
+			expectedContentType: "application/xml",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "yaml_preferred_by_quality_returns_yaml",
+				requestHeaders:       map[string]string{"Accept": "application/json;q=0.5, application/yaml"},
+				dbResponse:           plant,
+				expectedStatusCode:   200,
+				expectedResponseBody: "id: 1\nname: Dracaena Marginata\notherNames:\n- Dragon Tree\nlight: low\nhumidity: low\nwater: low",
+			},
+			method:              "GET",
+			expectedContentType: "application/yaml",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "wildcard_accept_returns_json",
+				requestHeaders:       map[string]string{"Accept": "*/*"},
+				dbResponse:           plant,
+				expectedStatusCode:   200,
+				expectedResponseBody: "{\"id\":1,\"name\":\"Dracaena Marginata\",\"otherNames\":[\"Dragon Tree\"],\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"}",
+			},
+			method:              "GET",
+			expectedContentType: "application/json",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "unsupported_accept_returns_406_and_error",
+				requestHeaders:       map[string]string{"Accept": "text/html, application/json;q=0"},
+				dbResponse:           plant,
+				expectedStatusCode:   406,
+				expectedResponseBody: "{\"type\":\"/problems/not-acceptable\",\"title\":\"Not acceptable\",\"status\":406,\"detail\":\"The Accept header must allow one of: application/json, application/xml, application/yaml, application/msgpack\",\"code\":\"not-acceptable\"}",
+			},
+			method:              "GET",
+			expectedContentType: "application/problem+json",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "xml_error_returns_xml_problem",
+				requestHeaders:       map[string]string{"Accept": "application/xml"},
+				dbResponse:           Plant{},
+				dbError:              &NotFoundError{},
+				expectedStatusCode:   404,
+				expectedResponseBody: "<problem xmlns=\"urn:ietf:rfc:7807\"><type>/problems/not-found</type><title>Not found</title><status>404</status><detail>The specified Plant was not found</detail><code>not-found</code></problem>",
+			},
+			method:              "GET",
+			expectedContentType: "application/problem+xml",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "xml_body_is_decoded",
+				requestHeaders:       map[string]string{"Content-Type": "application/xml"},
+				requestBody:          "<plant><name>Plant A</name><otherNames><otherName>A1</otherName></otherNames><light>Low</light><humidity>low</humidity><water>low</water></plant>",
+				expectedStatusCode:   201,
+				expectedResponseBody: "{}",
+			},
+			method:              "POST",
+			expectedContentType: "application/json",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "yaml_body_is_decoded",
+				requestHeaders:       map[string]string{"Content-Type": "application/yaml", "Accept": "application/yaml"},
+				requestBody:          "name: Plant A\nlight: low\nhumidity: low\n",
+				expectedStatusCode:   400,
+				expectedResponseBody: "type: /problems/validation-failed\ntitle: Validation failed\nstatus: 400\ndetail: The water value is required\ncode: validation-failed\nerrors:\n- field: water\n  code: required\n  message: The water value is required",
+			},
+			method:              "POST",
+			expectedContentType: "application/yaml",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "unsupported_content_type_returns_415_and_error",
+				requestHeaders:       map[string]string{"Content-Type": "text/plain"},
+				requestBody:          "Plant A",
+				expectedStatusCode:   415,
+				expectedResponseBody: "{\"type\":\"/problems/unsupported-media-type\",\"title\":\"Unsupported media type\",\"status\":415,\"detail\":\"The content type must be one of: application/json, application/xml, application/yaml, application/msgpack\",\"code\":\"unsupported-media-type\"}",
+			},
+			method:              "POST",
+			expectedContentType: "application/problem+json",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
+			req, _ := http.NewRequest(tc.method, "api/plants", strings.NewReader(tc.requestBody))
+			for header, value := range tc.requestHeaders {
+				req.Header.Set(header, value)
+			}
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			w := httptest.NewRecorder()
+			api := Api{DB: db}
+			handler := api.getPlant
+			if tc.method == "POST" {
+				handler = api.postPlant
+			}
+
+			// Act
+			negotiateContent(http.HandlerFunc(handler)).ServeHTTP(w, req)
+
+			// Assert
+			responseBody := strings.TrimSpace(w.Body.String())
+			if responseBody != tc.expectedResponseBody {
+				t.Errorf("handler returned unexpected body: got %v, want %v",
+					responseBody, tc.expectedResponseBody)
+			}
+			actualStatusCode := w.Result().StatusCode
+			if actualStatusCode != tc.expectedStatusCode {
+				t.Errorf("handler returned unexpected status code: got %v, want %v",
+					actualStatusCode, tc.expectedStatusCode)
+			}
+			if contentType := w.Header().Get("content-type"); contentType != tc.expectedContentType {
+				t.Errorf("handler returned unexpected content type: got %v, want %v",
+					contentType, tc.expectedContentType)
+			}
+		})
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	// Arrange
+	db := &MemoryDb{}
+	db.Connect(context.Background())
+	var body bytes.Buffer
+	encodeMsgpack(&body, PlantRequest{Name: "Plant A", OtherNames: []string{"A1"}, Light: "Bright Indirect", Humidity: "low", Water: "low"})
+	req, _ := http.NewRequest("POST", "api/plants", &body)
+	req.Header.Set("Content-Type", "application/msgpack")
+	w := httptest.NewRecorder()
+	api := Api{DB: db}
+
+	// Act
+	api.postPlant(w, req)
+	getReq, _ := http.NewRequest("GET", "api/plants", nil)
+	getReq.Header.Set("Accept", "application/x-msgpack")
+	getReq = mux.SetURLVars(getReq, map[string]string{"id": "1"})
+	getW := httptest.NewRecorder()
+	api.getPlant(getW, getReq)
+
+	// Assert
+	if w.Result().StatusCode != 201 {
+		t.Fatalf("handler returned unexpected status code: got %v, want 201", w.Result().StatusCode)
+	}
+	if contentType := getW.Header().Get("content-type"); contentType != "application/msgpack" {
+		t.Errorf("handler returned unexpected content type: got %v, want application/msgpack", contentType)
+	}
+	var plant Plant
+	if err := decodeMsgpack(getW.Body, &plant); err != nil {
+		t.Fatalf("handler returned unparseable body: %v", err)
+	}
+	if plant.PrettyString() != "Id: 1, Name: Plant A, OtherNames: [A1], Light: bright indirect, Humidity: low, Water: low" {
+		t.Errorf("handler returned unexpected plant: %v", plant.PrettyString())
+	}
+}
+
+func TestPostPlantBatch(t *testing.T) {
+	cases := []TestCase{
+		{
+			testName:             "all_or_nothing_batch_returns_200_and_results",
+			requestBody:          "[{\"name\":\"Plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"},{\"id\":7,\"name\":\"Plant B\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"}]",
+			dbResponse:           []PlantWriteResult{{Id: 3, Created: true}, {Id: 7}},
+			expectedStatusCode:   200,
+			expectedResponseBody: "{\"mode\":\"all-or-nothing\",\"results\":[{\"index\":0,\"status\":201,\"id\":3},{\"index\":1,\"status\":200,\"id\":7}]}",
+		},
+		{
+			testName:             "invalid_item_in_all_or_nothing_batch_returns_400_and_writes_nothing",
+			requestBody:          "[{\"name\":\"Plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"},{\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"}]",
+			dbError:              errors.New("the batch should not be written"),
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"mode\":\"all-or-nothing\",\"results\":[{\"index\":0,\"status\":424,\"code\":\"rolled-back\",\"detail\":\"The Plant was not written because another Plant in the batch is invalid\"},{\"index\":1,\"status\":400,\"code\":\"validation-failed\",\"detail\":\"The name value is required\",\"errors\":[{\"field\":\"name\",\"code\":\"required\",\"message\":\"The name value is required\"}]}]}",
+		},
+		{
+			testName:             "conflict_in_best_effort_batch_returns_207_and_results",
+			requestQuery:         "mode=best-effort",
+			requestBody:          "[{\"name\":\"Plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"},{\"name\":\"Plant B\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"}]",
+			dbResponse:           []PlantWriteResult{{Err: &ConflictError{ConflictingKey: "name", ConflictingValue: "Plant A"}}, {Id: 4, Created: true}},
+			expectedStatusCode:   207,
+			expectedResponseBody: "{\"mode\":\"best-effort\",\"results\":[{\"index\":0,\"status\":409,\"code\":\"conflict\",\"detail\":\"Plant with name 'Plant A' already exists\",\"errors\":[{\"field\":\"name\",\"code\":\"duplicate\",\"message\":\"Plant with name 'Plant A' already exists\"}]},{\"index\":1,\"status\":201,\"id\":4}]}",
+		},
+		{
+			testName:             "unknown_mode_returns_400_and_error",
+			requestQuery:         "mode=some",
+			requestBody:          "[]",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The mode must be all-or-nothing or best-effort\",\"code\":\"invalid-parameter\"}",
+		},
+		{
+			testName:             "empty_batch_returns_400_and_error",
+			requestBody:          "[]",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-body\",\"title\":\"Invalid request body\",\"status\":400,\"detail\":\"The batch must contain between 1 and 500 Plants\",\"code\":\"invalid-body\"}",
+		},
+		{
+			testName:             "error_db_response_returns_500_and_error",
+			requestBody:          "[{\"name\":\"Plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"}]",
+			dbResponse:           []PlantWriteResult{},
+			dbError:              errors.New("something went wrong!"),
+			expectedStatusCode:   500,
+			expectedResponseBody: "{\"type\":\"/problems/internal-error\",\"title\":\"Internal error\",\"status\":500,\"detail\":\"An error occurred while processing the request\",\"code\":\"internal-error\"}",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
+			req, _ := http.NewRequest("POST", "api/plants:batch", strings.NewReader(tc.requestBody))
+			req.URL.RawQuery = tc.requestQuery
+			w := httptest.NewRecorder()
+			api := Api{DB: db}
+
+			// Act
+			api.postPlantBatch(w, req)
+
+			// Assert
+			responseBody := strings.TrimSpace(w.Body.String())
+			if responseBody != tc.expectedResponseBody {
+				t.Errorf("handler returned unexpected body: got %v, want %v",
+					responseBody, tc.expectedResponseBody)
+			}
+			actualStatusCode := w.Result().StatusCode
+			if actualStatusCode != tc.expectedStatusCode {
+				t.Errorf("handler returned unexpected status code: got %v, want %v",
+					actualStatusCode, tc.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestPutPlant(t *testing.T) {
+	cases := []TestCase{
+		{
+			testName:             "valid_db_response_returns_200",
+			requestPathId:        "99",
+			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			dbError:              nil,
+			expectedStatusCode:   200,
+			expectedResponseBody: "{}",
+		},
+		{
+			testName:             "error_db_response_returns_500_and_error",
+			requestPathId:        "99",
+			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			dbError:              errors.New("something went wrong!"),
+			expectedStatusCode:   500,
+			expectedResponseBody: "{\"type\":\"/problems/internal-error\",\"title\":\"Internal error\",\"status\":500,\"detail\":\"An error occurred while processing the request\",\"code\":\"internal-error\"}",
+		},
+		{
+			testName:             "conflict_db_response_returns_409_and_error",
+			requestPathId:        "99",
+			requestBody:          "{\"name\":\"plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			dbError:              &ConflictError{ConflictingKey: "name", ConflictingValue: "plant X"},
+			expectedStatusCode:   409,
+			expectedResponseBody: "{\"type\":\"/problems/conflict\",\"title\":\"Conflict\",\"status\":409,\"detail\":\"Plant with name 'plant X' already exists\",\"code\":\"conflict\",\"errors\":[{\"field\":\"name\",\"code\":\"duplicate\",\"message\":\"Plant with name 'plant X' already exists\"}]}",
+		},
+		{
+			testName:             "invalid_payload_returns_400_and_error",
+			requestPathId:        "99",
+			requestBody:          "{\"name\":123,\"invalid\":\"plant\"}",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-body\",\"title\":\"Invalid request body\",\"status\":400,\"detail\":\"The request payload could not be parsed into a Plant\",\"code\":\"invalid-body\"}",
+		},
+		{
+			testName:             "invalid_id_returns_400_and_error",
+			requestPathId:        "abc",
+			requestBody:          "{\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The Plant id must be an integer\",\"code\":\"invalid-parameter\"}",
+		},
+		{
+			testName:             "failed_validation_returns_400_and_error",
+			requestPathId:        "99",
+			requestBody:          "{\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"otherNames\":[]}",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/validation-failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"The name value is required\",\"code\":\"validation-failed\",\"errors\":[{\"field\":\"name\",\"code\":\"required\",\"message\":\"The name value is required\"}]}",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
+			req, _ := http.NewRequest("PUT", "api/plants", strings.NewReader(tc.requestBody))
+			req = mux.SetURLVars(req, map[string]string{"id": tc.requestPathId})
+			w := httptest.NewRecorder()
+			api := Api{DB: db}
+
+			// Act
+			api.putPlant(w, req)
+
+			// Assert
+			responseBody := strings.TrimSpace(w.Body.String())
+			if responseBody != tc.expectedResponseBody {
+				t.Errorf("handler returned unexpected body: got %v, want %v",
+					responseBody, tc.expectedResponseBody)
+			}
+			actualStatusCode := w.Result().StatusCode
+			if actualStatusCode != tc.expectedStatusCode {
+				t.Errorf("handler returned unexpected status code: got %v, want %v",
+					actualStatusCode, tc.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestDeletePlant(t *testing.T) {
+	cases := []TestCase{
+		{
+			testName:             "valid_db_response_returns_204",
+			requestPathId:        "99",
+			dbError:              nil,
+			expectedStatusCode:   204,
+			expectedResponseBody: "{}",
+		},
+		{
+			testName:             "error_db_response_returns_500_and_error",
+			requestPathId:        "99",
+			dbError:              errors.New("something went wrong!"),
+			expectedStatusCode:   500,
+			expectedResponseBody: "{\"type\":\"/problems/internal-error\",\"title\":\"Internal error\",\"status\":500,\"detail\":\"An error occurred while processing the request\",\"code\":\"internal-error\"}",
+		},
+		{
+			testName:             "invalid_id_returns_400_and_error",
+			requestPathId:        "abc",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The Plant id must be an integer\",\"code\":\"invalid-parameter\"}",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			db := &MockDB{DbResponse: tc.dbResponse, DbError: tc.dbError}
+			req, _ := http.NewRequest("PUT", "api/plants", nil)
+			req = mux.SetURLVars(req, map[string]string{"id": tc.requestPathId})
+			w := httptest.NewRecorder()
+			api := Api{DB: db}
+
+			// Act
+			api.deletePlant(w, req)
+
+			// Assert
+			responseBody := strings.TrimSpace(w.Body.String())
+			if responseBody != tc.expectedResponseBody {
+				t.Errorf("handler returned unexpected body: got %v, want %v",
+					responseBody, tc.expectedResponseBody)
+			}
+			actualStatusCode := w.Result().StatusCode
+			if actualStatusCode != tc.expectedStatusCode {
+				t.Errorf("handler returned unexpected status code: got %v, want %v",
+					actualStatusCode, tc.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestPatchPlant(t *testing.T) {
+	cases := []struct {
+		testName             string
+		requestPathId        string
+		contentType          string
+		requestBody          string
+		expectedStatusCode   int
+		expectedResponseBody string
+		expectedPlant        string
+	}{
+		{
+			testName:             "merge_patch_returns_200_and_changes_fields",
+			requestPathId:        "1",
+			contentType:          "application/merge-patch+json",
+			requestBody:          "{\"water\":\"high\",\"otherNames\":null}",
+			expectedStatusCode:   200,
+			expectedResponseBody: "{}",
+			expectedPlant:        "Id: 1, Name: Plant A, OtherNames: [], Light: low, Humidity: low, Water: high",
+		},
+		{
+			testName:             "json_patch_returns_200_and_changes_fields",
+			requestPathId:        "1",
+			contentType:          "application/json-patch+json",
+			requestBody:          "[{\"op\":\"test\",\"path\":\"/name\",\"value\":\"Plant A\"},{\"op\":\"add\",\"path\":\"/otherNames/-\",\"value\":\"Other name B\"},{\"op\":\"replace\",\"path\":\"/light\",\"value\":\"Bright  Direct\"}]",
+			expectedStatusCode:   200,
+			expectedResponseBody: "{}",
+			expectedPlant:        "Id: 1, Name: Plant A, OtherNames: [Other name A, Other name B], Light: bright direct, Humidity: low, Water: low",
+		},
+		{
+			testName:             "failed_json_patch_test_returns_409_and_error",
+			requestPathId:        "1",
+			contentType:          "application/json-patch+json",
+			requestBody:          "[{\"op\":\"test\",\"path\":\"/name\",\"value\":\"Plant X\"},{\"op\":\"replace\",\"path\":\"/light\",\"value\":\"high\"}]",
+			expectedStatusCode:   409,
+			expectedResponseBody: "{\"type\":\"/problems/patch-test-failed\",\"title\":\"Patch test failed\",\"status\":409,\"detail\":\"The JSON Patch test of '/name' failed\",\"code\":\"patch-test-failed\"}",
+			expectedPlant:        "Id: 1, Name: Plant A, OtherNames: [Other name A], Light: low, Humidity: low, Water: low",
+		},
+		{
+			testName:             "conflicting_name_returns_409_and_error",
+			requestPathId:        "1",
+			contentType:          "application/merge-patch+json",
+			requestBody:          "{\"name\":\"Plant B\"}",
+			expectedStatusCode:   409,
+			expectedResponseBody: "{\"type\":\"/problems/conflict\",\"title\":\"Conflict\",\"status\":409,\"detail\":\"Plant with name 'Plant B' already exists\",\"code\":\"conflict\",\"errors\":[{\"field\":\"name\",\"code\":\"duplicate\",\"message\":\"Plant with name 'Plant B' already exists\"}]}",
+			expectedPlant:        "Id: 1, Name: Plant A, OtherNames: [Other name A], Light: low, Humidity: low, Water: low",
+		},
+		{
+			testName:             "failed_validation_returns_400_and_error",
+			requestPathId:        "1",
+			contentType:          "application/merge-patch+json",
+			requestBody:          "{\"light\":null}",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/validation-failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"The light value is required\",\"code\":\"validation-failed\",\"errors\":[{\"field\":\"light\",\"code\":\"required\",\"message\":\"The light value is required\"}]}",
+			expectedPlant:        "Id: 1, Name: Plant A, OtherNames: [Other name A], Light: low, Humidity: low, Water: low",
+		},
+		{
+			testName:             "unknown_field_returns_400_and_error",
+			requestPathId:        "1",
+			contentType:          "application/merge-patch+json",
+			requestBody:          "{\"colour\":\"green\"}",
+			expectedStatusCode:   400,
+			expectedResponseBody: "{\"type\":\"/problems/invalid-body\",\"title\":\"Invalid request body\",\"status\":400,\"detail\":\"The patched payload could not be parsed into a Plant\",\"code\":\"invalid-body\"}",
+			expectedPlant:        "Id: 1, Name: Plant A, OtherNames: [Other name A], Light: low, Humidity: low, Water: low",
+		},
+		{
+			testName:             "unsupported_content_type_returns_415_and_error",
+			requestPathId:        "1",
+			contentType:          "application/json",
+			requestBody:          "{\"water\":\"high\"}",
+			expectedStatusCode:   415,
+			expectedResponseBody: "{\"type\":\"/problems/unsupported-media-type\",\"title\":\"Unsupported media type\",\"status\":415,\"detail\":\"The content type must be application/merge-patch+json or application/json-patch+json\",\"code\":\"unsupported-media-type\"}",
+			expectedPlant:        "Id: 1, Name: Plant A, OtherNames: [Other name A], Light: low, Humidity: low, Water: low",
+		},
+		{
+			testName:             "missing_plant_returns_404_and_error",
+			requestPathId:        "99",
+			contentType:          "application/merge-patch+json",
+			requestBody:          "{\"water\":\"high\"}",
+			expectedStatusCode:   404,
+			expectedResponseBody: "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified Plant was not found\",\"code\":\"not-found\"}",
+			expectedPlant:        "Id: 1, Name: Plant A, OtherNames: [Other name A], Light: low, Humidity: low, Water: low",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			db := &MemoryDb{}
+			db.Connect(context.Background())
+			db.CreatePlant(context.Background(), Plant{Name: "Plant A", OtherNames: []string{"Other name A"}, Light: "low", Humidity: "low", Water: "low"}, WriteOptions{})
+			db.CreatePlant(context.Background(), Plant{Name: "Plant B", Light: "low", Humidity: "low", Water: "low"}, WriteOptions{})
+			req, _ := http.NewRequest("PATCH", "api/plants", strings.NewReader(tc.requestBody))
+			req.Header.Set("content-type", tc.contentType)
+			req = mux.SetURLVars(req, map[string]string{"id": tc.requestPathId})
+			w := httptest.NewRecorder()
+			api := Api{DB: db}
+
+			// Act
+			api.patchPlant(w, req)
+
+			// Assert
+			responseBody := strings.TrimSpace(w.Body.String())
+			if responseBody != tc.expectedResponseBody {
+				t.Errorf("handler returned unexpected body: got %v, want %v",
+					responseBody, tc.expectedResponseBody)
+			}
+			actualStatusCode := w.Result().StatusCode
+			if actualStatusCode != tc.expectedStatusCode {
+				t.Errorf("handler returned unexpected status code: got %v, want %v",
+					actualStatusCode, tc.expectedStatusCode)
+			}
+			plant, _ := db.GetPlantById(context.Background(), 1)
+			if plant.PrettyString() != tc.expectedPlant {
+				t.Errorf("handler left unexpected plant: got %v, want %v",
+					plant.PrettyString(), tc.expectedPlant)
+			}
+		})
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	cases := []struct {
+		testName           string
+		method             string
+		ifMatch            string
+		expectedStatusCode int
+		expectedVersion    int
+		expectedETag       string
+	}{
+		{testName: "put_with_current_etag_returns_200", method: "PUT", ifMatch: "\"2\"", expectedStatusCode: 200, expectedVersion: 3, expectedETag: "\"3\""},
+		{testName: "put_with_stale_etag_returns_412", method: "PUT", ifMatch: "\"1\"", expectedStatusCode: 412, expectedVersion: 2},
+		{testName: "put_with_weak_etag_returns_412", method: "PUT", ifMatch: "W/\"2\"", expectedStatusCode: 412, expectedVersion: 2},
+		{testName: "patch_with_any_etag_returns_200", method: "PATCH", ifMatch: "*", expectedStatusCode: 200, expectedVersion: 3, expectedETag: "\"3\""},
+		{testName: "patch_with_stale_etag_returns_412", method: "PATCH", ifMatch: "\"1\", \"3\"", expectedStatusCode: 412, expectedVersion: 2},
+		{testName: "delete_with_current_etag_returns_204", method: "DELETE", ifMatch: "\"1\", \"2\"", expectedStatusCode: 204},
+		{testName: "delete_with_stale_etag_returns_412", method: "DELETE", ifMatch: "\"1\"", expectedStatusCode: 412, expectedVersion: 2},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			db := &MemoryDb{}
+			db.Connect(context.Background())
+			db.CreatePlant(context.Background(), Plant{Name: "Plant A", Light: "low", Humidity: "low", Water: "low"}, WriteOptions{})
+			db.PatchPlant(context.Background(), 1, map[string]interface{}{"water": "high"}, WriteOptions{})
+			body := "{\"name\":\"Plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"}"
+			req, _ := http.NewRequest(tc.method, "api/plants", strings.NewReader(body))
+			if tc.method == "PATCH" {
+				req.Header.Set("content-type", "application/merge-patch+json")
+			}
+			req.Header.Set("If-Match", tc.ifMatch)
+			req = mux.SetURLVars(req, map[string]string{"id": "1"})
+			w := httptest.NewRecorder()
+			api := Api{DB: db}
+
+			// Act
+			switch tc.method {
+			case "PUT":
+				api.putPlant(w, req)
+			case "PATCH":
+				api.patchPlant(w, req)
+			case "DELETE":
+				api.deletePlant(w, req)
+			}
+
+			// Assert
+			actualStatusCode := w.Result().StatusCode
+			if actualStatusCode != tc.expectedStatusCode {
+				t.Errorf("handler returned unexpected status code: got %v, want %v",
+					actualStatusCode, tc.expectedStatusCode)
+			}
+			plant, _ := db.GetPlantById(context.Background(), 1)
+			if plant.Version != tc.expectedVersion {
+				t.Errorf("handler left unexpected version: got %v, want %v",
+					plant.Version, tc.expectedVersion)
+			}
+			if etag := w.Header().Get("etag"); etag != tc.expectedETag {
+				t.Errorf("handler returned unexpected ETag: got %v, want %v", etag, tc.expectedETag)
+			}
+		})
+	}
+}
+
+func TestTrash(t *testing.T) {
+	// Arrange
+	viper.Set("Admin.ApiKey", "secret")
+	defer viper.Set("Admin.ApiKey", "")
+	db := &MemoryDb{}
+	db.Connect(context.Background())
+	db.CreatePlant(context.Background(), Plant{Name: "Plant A"}, WriteOptions{})
+	db.CreatePlant(context.Background(), Plant{Name: "Plant B"}, WriteOptions{})
+	api := Api{DB: db}
+	send := func(handler http.HandlerFunc, method string, id string, adminKey string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "api/plants", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		req.Header.Set("X-Admin-Key", adminKey)
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	steps := []struct {
+		stepName             string
+		handler              http.HandlerFunc
+		method               string
+		id                   string
+		adminKey             string
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{"delete_hides_plant", api.deletePlant, "DELETE", "1", "", 204, "{}"},
+		{"deleted_plant_is_not_found", api.getPlant, "GET", "1", "", 404, "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified Plant was not found\",\"code\":\"not-found\"}"},
+		{"restore_of_live_plant_returns_404", api.restorePlant, "POST", "2", "", 404, "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified Plant was not found in the trash\",\"code\":\"not-found\"}"},
+		{"restore_returns_200", api.restorePlant, "POST", "1", "", 200, "{}"},
+		{"restored_plant_is_found", api.getPlant, "GET", "1", "", 200, ""},
+		{"purge_without_admin_key_returns_403", api.purgePlant, "DELETE", "1", "wrong", 403, "{\"type\":\"/problems/forbidden\",\"title\":\"Forbidden\",\"status\":403,\"detail\":\"Only administrators can purge Plants\",\"code\":\"forbidden\"}"},
+		{"purge_of_live_plant_returns_404", api.purgePlant, "DELETE", "1", "secret", 404, "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified Plant was not found in the trash\",\"code\":\"not-found\"}"},
+		{"delete_again_returns_204", api.deletePlant, "DELETE", "1", "", 204, "{}"},
+		{"purge_returns_204", api.purgePlant, "DELETE", "1", "secret", 204, "{}"},
+		{"purged_plant_cant_be_restored", api.restorePlant, "POST", "1", "", 404, "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified Plant was not found in the trash\",\"code\":\"not-found\"}"},
+	}
+
+	for _, step := range steps {
+		// Act
+		w := send(step.handler, step.method, step.id, step.adminKey)
+
+		// Assert
+		responseBody := strings.TrimSpace(w.Body.String())
+		if step.expectedResponseBody != "" && responseBody != step.expectedResponseBody {
+			t.Errorf("%v: handler returned unexpected body: got %v, want %v",
+				step.stepName, responseBody, step.expectedResponseBody)
+		}
+		actualStatusCode := w.Result().StatusCode
+		if actualStatusCode != step.expectedStatusCode {
+			t.Errorf("%v: handler returned unexpected status code: got %v, want %v",
+				step.stepName, actualStatusCode, step.expectedStatusCode)
+		}
+	}
+}
+
+func TestPlantHistory(t *testing.T) {
+	// Arrange
+	db := &MemoryDb{}
+	db.Connect(context.Background())
+	db.CreatePlant(context.Background(), Plant{Name: "Plant A", Water: "low"}, WriteOptions{Actor: "creator"})
+	db.UpsertPlant(context.Background(), 1, Plant{Name: "Plant A", Water: "high"}, WriteOptions{Actor: "editor"})
+	db.CreatePlant(context.Background(), Plant{Name: "Plant B"}, WriteOptions{})
+	db.UpsertPlant(context.Background(), 2, Plant{Name: "Plant C"}, WriteOptions{})
+	db.CreatePlant(context.Background(), Plant{Name: "Plant B"}, WriteOptions{})
+	api := Api{DB: db}
+	send := func(handler http.HandlerFunc, method string, vars map[string]string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "api/plants", nil)
+		req = mux.SetURLVars(req, vars)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+	steps := []struct {
+		stepName             string
+		handler              http.HandlerFunc
+		method               string
+		vars                 map[string]string
+		headers              map[string]string
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{"history_of_missing_plant_returns_404", api.getPlantHistory, "GET", map[string]string{"id": "9"}, nil, 404, "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified Plant was not found\",\"code\":\"not-found\"}"},
+		{"history_with_invalid_id_returns_400", api.getPlantHistory, "GET", map[string]string{"id": "abc"}, nil, 400, "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The Plant id must be an integer\",\"code\":\"invalid-parameter\"}"},
+		{"revision_with_invalid_rev_returns_400", api.getPlantRevision, "GET", map[string]string{"id": "1", "rev": "abc"}, nil, 400, "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The revision must be an integer\",\"code\":\"invalid-parameter\"}"},
+		{"missing_revision_returns_404", api.getPlantRevision, "GET", map[string]string{"id": "1", "rev": "9"}, nil, 404, "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified revision was not found\",\"code\":\"not-found\"}"},
+		{"revert_with_stale_if_match_returns_412", api.revertPlant, "POST", map[string]string{"id": "1", "rev": "1"}, map[string]string{"If-Match": "\"1\""}, 412, "{\"type\":\"/problems/precondition-failed\",\"title\":\"Precondition failed\",\"status\":412,\"detail\":\"The Plant has been changed since it was retrieved\",\"code\":\"precondition-failed\"}"},
+		{"revert_returns_200", api.revertPlant, "POST", map[string]string{"id": "1", "rev": "1"}, map[string]string{"If-Match": "\"2\"", "X-Client-Id": "reverter"}, 200, "{}"},
+		{"revert_to_taken_name_returns_409", api.revertPlant, "POST", map[string]string{"id": "2", "rev": "1"}, nil, 409, "{\"type\":\"/problems/conflict\",\"title\":\"Conflict\",\"status\":409,\"detail\":\"Plant with name 'Plant B' already exists\",\"code\":\"conflict\",\"errors\":[{\"field\":\"name\",\"code\":\"duplicate\",\"message\":\"Plant with name 'Plant B' already exists\"}]}"},
+	}
+
+	for _, step := range steps {
+		// Act
+		w := send(step.handler, step.method, step.vars, step.headers)
+
+		// Assert
+		responseBody := strings.TrimSpace(w.Body.String())
+		if step.expectedResponseBody != "" && responseBody != step.expectedResponseBody {
+			t.Errorf("%v: handler returned unexpected body: got %v, want %v",
+				step.stepName, responseBody, step.expectedResponseBody)
+		}
+		actualStatusCode := w.Result().StatusCode
+		if actualStatusCode != step.expectedStatusCode {
+			t.Errorf("%v: handler returned unexpected status code: got %v, want %v",
+				step.stepName, actualStatusCode, step.expectedStatusCode)
+		}
+	}
+
+	w := send(api.getPlantHistory, "GET", map[string]string{"id": "1"}, nil)
+	var history []PlantRevision
+	json.Unmarshal(w.Body.Bytes(), &history)
+	if len(history) != 3 || history[2].Actor != "reverter" || history[2].After.Water != "low" || history[2].Revision != 3 {
+		t.Errorf("handler returned unexpected history: %v", w.Body.String())
+	}
+}
+
+func TestRouterPathParameters(t *testing.T) {
+	// Arrange
+	db := &MemoryDb{}
+	db.Connect(context.Background())
+	db.CreatePlant(context.Background(), Plant{Name: "Dracaena Marginata", Light: "low", Humidity: "low", Water: "low"}, WriteOptions{})
+	db.CreatePlant(context.Background(), Plant{Name: "Plant B", Light: "low", Humidity: "low", Water: "low"}, WriteOptions{})
+	api := Api{DB: db}
+	api.initialiseRouter()
+	send := func(method string, path string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		api.Router.ServeHTTP(w, req)
+		return w
+	}
+	steps := []struct {
+		stepName             string
+		method               string
+		path                 string
+		requestBody          string
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{"get_by_id_returns_200", "GET", "/plants/1", "", 200, "{\"id\":1,\"name\":\"Dracaena Marginata\",\"otherNames\":null,\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"version\":1}"},
+		{"get_by_invalid_id_returns_400", "GET", "/plants/abc", "", 400, "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The Plant id must be an integer\",\"code\":\"invalid-parameter\"}"},
+		{"get_by_slug_returns_200", "GET", "/plants/by-slug/dracaena-marginata", "", 200, "{\"id\":1,\"name\":\"Dracaena Marginata\",\"otherNames\":null,\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"version\":1}"},
+		{"get_by_invalid_slug_returns_400", "GET", "/plants/by-slug/Dracaena_Marginata", "", 400, "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The Plant slug must be lower case letters and digits separated by hyphens\",\"code\":\"invalid-parameter\"}"},
+		{"get_by_missing_slug_returns_404", "GET", "/plants/by-slug/plant-c", "", 404, "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified Plant was not found\",\"code\":\"not-found\"}"},
+		{"put_by_negative_id_returns_400", "PUT", "/plants/-1", "{\"name\":\"Plant C\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"high\"}", 400, "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The Plant id must be a positive integer\",\"code\":\"invalid-parameter\"}"},
+		{"put_by_id_returns_200", "PUT", "/plants/2", "{\"name\":\"Plant C\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"high\"}", 200, "{}"},
+		{"get_by_new_slug_returns_200", "GET", "/plants/by-slug/plant-c", "", 200, "{\"id\":2,\"name\":\"Plant C\",\"otherNames\":null,\"light\":\"low\",\"humidity\":\"low\",\"water\":\"high\",\"version\":2}"},
+		{"delete_by_id_returns_204", "DELETE", "/plants/2", "", 204, ""},
+		{"get_deleted_by_id_returns_404", "GET", "/plants/2", "", 404, "{\"type\":\"/problems/not-found\",\"title\":\"Not found\",\"status\":404,\"detail\":\"The specified Plant was not found\",\"code\":\"not-found\"}"},
+		{"get_revision_returns_200", "GET", "/plants/2/history/1", "", 200, ""},
+	}
+
+	for _, step := range steps {
+		// Act
+		w := send(step.method, step.path, step.requestBody)
+
+		// Assert
+		responseBody := strings.TrimSpace(w.Body.String())
+		if step.expectedResponseBody != "" && responseBody != step.expectedResponseBody {
+			t.Errorf("%v: handler returned unexpected body: got %v, want %v",
+				step.stepName, responseBody, step.expectedResponseBody)
+		}
+		actualStatusCode := w.Result().StatusCode
+		if actualStatusCode != step.expectedStatusCode {
+			t.Errorf("%v: handler returned unexpected status code: got %v, want %v",
+				step.stepName, actualStatusCode, step.expectedStatusCode)
+		}
+	}
+}
+
+func TestImportPlants(t *testing.T) {
+	// Arrange
+	db := &MemoryDb{}
+	db.Connect(context.Background())
+	db.CreatePlant(context.Background(), Plant{Name: "Plant A", OtherNames: []string{"A"}, Light: "low", Humidity: "low", Water: "low"}, WriteOptions{})
+	db.CreatePlant(context.Background(), Plant{Name: "Plant B", Light: "low", Humidity: "low", Water: "low"}, WriteOptions{})
+	api := Api{DB: db}
+	csv := "Name,otherNames,light,humidity,water\n" +
+		"Plant A,A,low,low,low\n" +
+		"Plant B,B1; B2,Bright Indirect,low,low\n" +
+		"Plant C,,medium,high,moderate\n" +
+		"Plant D,,medium,soggy,moderate\n" +
+		"Plant C,,low,low,low\n"
+	send := func(query string, contentType string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "api/plants:import", strings.NewReader(body))
+		req.URL.RawQuery = query
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		api.importPlants(w, req)
+		return w
+	}
+	expectedRows := "[{\"row\":2,\"status\":\"skipped\",\"id\":1,\"name\":\"Plant A\"},{\"row\":3,\"status\":\"updated\",\"id\":2,\"name\":\"Plant B\"},{\"row\":4,\"status\":\"created\",\"id\":3,\"name\":\"Plant C\"}," +
+		"{\"row\":5,\"status\":\"failed\",\"name\":\"Plant D\",\"errors\":[{\"field\":\"humidity\",\"code\":\"invalid-value\",\"message\":\"The humidity value must be one of: low, moderate, high\"}]}," +
+		"{\"row\":6,\"status\":\"failed\",\"name\":\"Plant C\",\"errors\":[{\"field\":\"name\",\"code\":\"duplicate\",\"message\":\"The name is already used by row 4\"}]}]"
+	steps := []struct {
+		stepName             string
+		query                string
+		contentType          string
+		body                 string
+		expectedStatusCode   int
+		expectedResponseBody string
+	}{
+		{"dry_run_returns_report_without_ids_of_new_plants", "dryRun=true", "text/csv", csv, 200,
+			"{\"dryRun\":true,\"created\":1,\"updated\":1,\"skipped\":1,\"failed\":2,\"rows\":" + strings.Replace(expectedRows, ",\"id\":3", "", 1) + "}"},
+		{"import_returns_report", "", "text/csv; charset=utf-8", csv, 200,
+			"{\"dryRun\":false,\"created\":1,\"updated\":1,\"skipped\":1,\"failed\":2,\"rows\":" + expectedRows + "}"},
+		{"unknown_column_returns_400", "", "text/csv", "name,colour\nPlant E,green\n", 400,
+			"{\"type\":\"/problems/invalid-body\",\"title\":\"Invalid request body\",\"status\":400,\"detail\":\"The CSV column 'colour' is not a Plant field\",\"code\":\"invalid-body\"}"},
+		{"json_body_returns_415", "", "application/json", "[]", 415,
+			"{\"type\":\"/problems/unsupported-media-type\",\"title\":\"Unsupported media type\",\"status\":415,\"detail\":\"The content type must be text/csv\",\"code\":\"unsupported-media-type\"}"},
+	}
+
+	for _, step := range steps {
+		// Act
+		w := send(step.query, step.contentType, step.body)
+
+		// Assert
+		responseBody := strings.TrimSpace(w.Body.String())
+		if responseBody != step.expectedResponseBody {
+			t.Errorf("%v: handler returned unexpected body: got %v, want %v",
+				step.stepName, responseBody, step.expectedResponseBody)
+		}
+		actualStatusCode := w.Result().StatusCode
+		if actualStatusCode != step.expectedStatusCode {
+			t.Errorf("%v: handler returned unexpected status code: got %v, want %v",
+				step.stepName, actualStatusCode, step.expectedStatusCode)
+		}
+	}
+
+	plant, _ := db.GetPlantById(context.Background(), 2)
+	if plant.Light != "bright indirect" || strings.Join(plant.OtherNames, ",") != "B1,B2" {
+		t.Errorf("import left unexpected plant: %v", plant.PrettyString())
+	}
+}
+
+func TestOpenApiDocumentsEveryRoute(t *testing.T) {
+	// Arrange
+	viper.Set("OpenApi.DocsUi", true)
+	defer viper.Set("OpenApi.DocsUi", false)
+	api := Api{DB: &MockDB{}}
+	api.initialiseRouter()
+	// The docs page is for people rather than clients
+	undocumented := map[string]bool{"GET /docs": true}
+
+	// Act
+	document := newOpenApiDocument()
+	routes := make(map[string]bool)
+	api.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, pathErr := route.GetPathTemplate()
+		methods, methodsErr := route.GetMethods()
+		if pathErr != nil || methodsErr != nil {
+			return nil
+		}
+		for _, method := range methods {
+			routes[method+" "+path] = true
+		}
+		return nil
+	})
+
+	// Assert
+	for route := range routes {
+		parts := strings.SplitN(route, " ", 2)
+		if _, ok := document.Paths[parts[1]][strings.ToLower(parts[0])]; !ok && !undocumented[route] {
+			t.Errorf("route %v is not documented", route)
+		}
+	}
+	for path, operations := range document.Paths {
+		for method := range operations {
+			if route := strings.ToUpper(method) + " " + path; !routes[route] {
+				t.Errorf("documented route %v is not registered", route)
+			}
+		}
+	}
+}
+
+func TestGetOpenApiSpec(t *testing.T) {
+	// Arrange
+	req, _ := http.NewRequest("GET", "openapi.json", nil)
+	w := httptest.NewRecorder()
+	api := Api{DB: &MockDB{}}
+
+	// Act
+	api.getOpenApiSpec(w, req)
+
+	// Assert
+	if w.Result().StatusCode != 200 {
+		t.Errorf("handler returned unexpected status code: got %v, want 200", w.Result().StatusCode)
+	}
+	var document struct {
+		OpenApi    string                            `json:"openapi"`
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			Schemas map[string]interface{} `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &document); err != nil {
+		t.Fatalf("handler returned unparseable body: %v", w.Body.String())
+	}
+	if document.OpenApi != "3.0.3" || document.Paths["/plants/{id}"]["get"] == nil {
+		t.Errorf("handler returned unexpected document: %v", w.Body.String())
+	}
+	for _, schema := range []string{"Plant", "PlantRequest", "ErrorResponse"} {
+		if document.Components.Schemas[schema] == nil {
+			t.Errorf("handler returned no schema for %v", schema)
+		}
+	}
+}
+
+func TestValidateRequests(t *testing.T) {
+	defer viper.Reset()
+	viper.Set("Server.MaxBodyBytes", 512)
+	cases := []struct {
+		TestCase
+		method      string
+		path        string
+		contentType string
+	}{
+		{
+			TestCase: TestCase{
+				testName:             "unknown_and_mistyped_fields_return_400_and_pointers",
+				requestBody:          "{\"name\":123,\"invalid\":\"plant\",\"light\":\"low\",\"humidity\":\"low\"}",
+				expectedStatusCode:   400,
+				expectedResponseBody: "{\"type\":\"/problems/validation-failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"The field '/invalid' is not allowed; The value at '/name' must be a string; The water value is required\",\"code\":\"validation-failed\",\"errors\":[{\"field\":\"invalid\",\"pointer\":\"/invalid\",\"code\":\"unknown\",\"message\":\"The field '/invalid' is not allowed\"},{\"field\":\"name\",\"pointer\":\"/name\",\"code\":\"invalid-type\",\"message\":\"The value at '/name' must be a string\"},{\"field\":\"water\",\"pointer\":\"/water\",\"code\":\"required\",\"message\":\"The water value is required\"}]}",
+			},
+			method: "POST",
+			path:   "/plants",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "nested_batch_errors_return_400_and_pointers",
+				requestBody:          "[{\"name\":\"Plant A\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"},{\"name\":\"Plant B\",\"otherNames\":[\"B1\",2],\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\",\"colour\":\"green\"}]",
+				expectedStatusCode:   400,
+				expectedResponseBody: "{\"type\":\"/problems/validation-failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"The field '/1/colour' is not allowed; The value at '/1/otherNames/1' must be a string\",\"code\":\"validation-failed\",\"errors\":[{\"field\":\"colour\",\"pointer\":\"/1/colour\",\"code\":\"unknown\",\"message\":\"The field '/1/colour' is not allowed\"},{\"field\":\"otherNames\",\"pointer\":\"/1/otherNames/1\",\"code\":\"invalid-type\",\"message\":\"The value at '/1/otherNames/1' must be a string\"}]}",
+			},
+			method: "POST",
+			path:   "/plants:batch",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "unknown_yaml_field_returns_400_and_pointer",
+				requestBody:          "name: Plant A\nlight: low\nhumidity: low\nwater: low\nsize: large\n",
+				expectedStatusCode:   400,
+				expectedResponseBody: "{\"type\":\"/problems/validation-failed\",\"title\":\"Validation failed\",\"status\":400,\"detail\":\"The field '/size' is not allowed\",\"code\":\"validation-failed\",\"errors\":[{\"field\":\"size\",\"pointer\":\"/size\",\"code\":\"unknown\",\"message\":\"The field '/size' is not allowed\"}]}",
+			},
+			method:      "POST",
+			path:        "/plants",
+			contentType: "application/x-yaml",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "valid_body_reaches_handler",
+				requestBody:          "{\"name\":\"Plant A\",\"otherNames\":[],\"light\":\"Low\",\"humidity\":\"low\",\"water\":\"low\"}",
+				expectedStatusCode:   201,
+				expectedResponseBody: "{}",
+			},
+			method: "POST",
+			path:   "/plants",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "oversized_body_returns_413_and_error",
+				requestBody:          "{\"name\":\"" + strings.Repeat("a", 512) + "\",\"light\":\"low\",\"humidity\":\"low\",\"water\":\"low\"}",
+				expectedStatusCode:   413,
+				expectedResponseBody: "{\"type\":\"/problems/body-too-large\",\"title\":\"Request body too large\",\"status\":413,\"detail\":\"The request body must be at most 512 bytes\",\"code\":\"body-too-large\"}",
+			},
+			method: "POST",
+			path:   "/plants",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "null_optional_list_reaches_handler",
+				requestBody:          "{\"name\":\"Plant A\",\"otherNames\":null,\"light\":\"Low\",\"humidity\":\"low\",\"water\":\"low\"}",
+				expectedStatusCode:   201,
+				expectedResponseBody: "{}",
+			},
+			method: "POST",
+			path:   "/plants",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "unknown_and_mistyped_query_parameters_return_400_and_errors",
+				expectedStatusCode:   400,
+				expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The query parameter 'colour' is not supported; The limit parameter must be an integer\",\"code\":\"invalid-parameter\",\"errors\":[{\"field\":\"colour\",\"code\":\"unknown\",\"message\":\"The query parameter 'colour' is not supported\"},{\"field\":\"limit\",\"code\":\"invalid-type\",\"message\":\"The limit parameter must be an integer\"}]}",
+			},
+			method: "GET",
+			path:   "/plants/search?q=aloe&limit=ten&colour=green",
+		},
+		{
+			TestCase: TestCase{
+				testName:             "missing_required_query_parameter_returns_400_and_error",
+				expectedStatusCode:   400,
+				expectedResponseBody: "{\"type\":\"/problems/invalid-parameter\",\"title\":\"Invalid parameter\",\"status\":400,\"detail\":\"The name parameter is required\",\"code\":\"invalid-parameter\",\"errors\":[{\"field\":\"name\",\"code\":\"required\",\"message\":\"The name parameter is required\"}]}",
+			},
+			method: "GET",
+			path:   "/plants/suggest",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			api := Api{DB: &MockDB{DbResponse: []Plant{}}}
+			api.initialiseRouter()
+			req, _ := http.NewRequest(tc.method, tc.path, strings.NewReader(tc.requestBody))
+			if tc.contentType != "" {
+				req.Header.Set("content-type", tc.contentType)
+			}
+			w := httptest.NewRecorder()
+
+			// Act
+			api.Router.ServeHTTP(w, req)
+
+			// Assert
+			responseBody := strings.TrimSpace(w.Body.String())
+			if responseBody != tc.expectedResponseBody {
+				t.Errorf("handler returned unexpected body: got %v, want %v",
+					responseBody, tc.expectedResponseBody)
+			}
+			actualStatusCode := w.Result().StatusCode
+			if actualStatusCode != tc.expectedStatusCode {
+				t.Errorf("handler returned unexpected status code: got %v, want %v",
+					actualStatusCode, tc.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestHealthChecks(t *testing.T) {
+	cases := []struct {
+		testName               string
+		path                   string
+		ready                  bool
+		dbError                error
+		expectedStatusCode     int
+		expectedStatus         string
+		expectedDatabaseStatus string
+	}{
+		{"liveness_returns_200", "/healthz", false, errors.New("something went wrong!"), 200, "up", ""},
+		{"readiness_returns_200", "/readyz", true, nil, 200, "up", "up"},
+		{"readiness_with_failed_ping_returns_503", "/readyz", true, errors.New("something went wrong!"), 503, "down", "down"},
+		{"readiness_while_shutting_down_returns_503", "/readyz", false, nil, 503, "down", "up"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.testName, func(t *testing.T) {
+			// Arrange
+			api := Api{DB: &MockDB{DbError: tc.dbError}}
+			api.initialiseRouter()
+			api.setReady(tc.ready)
+			req, _ := http.NewRequest("GET", tc.path, nil)
+			w := httptest.NewRecorder()
+
+			// Act
+			api.Router.ServeHTTP(w, req)
+
+			// Assert
+			var response HealthResponse
+			json.Unmarshal(w.Body.Bytes(), &response)
+			if response.Status != tc.expectedStatus {
+				t.Errorf("handler returned unexpected status: got %v, want %v", response.Status, tc.expectedStatus)
+			}
+			databaseStatus := ""
+			for _, check := range response.Checks {
+				if check.Name == "database" {
+					databaseStatus = check.Status
+				}
+			}
+			if databaseStatus != tc.expectedDatabaseStatus {
+				t.Errorf("handler returned unexpected database status: got %v, want %v", databaseStatus, tc.expectedDatabaseStatus)
+			}
+			actualStatusCode := w.Result().StatusCode
+			if actualStatusCode != tc.expectedStatusCode {
+				t.Errorf("handler returned unexpected status code: got %v, want %v",
+					actualStatusCode, tc.expectedStatusCode)
+			}
+		})
+	}
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	// Arrange
+	started, release := make(chan bool), make(chan bool)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		<-release
+		w.WriteHeader(204)
+	})}
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	go server.Serve(listener)
+	api := Api{}
+	api.setReady(true)
+	statusCodes := make(chan int)
+	go func() {
+		res, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			statusCodes <- 0
+			return
+		}
+		statusCodes <- res.StatusCode
+	}()
+	<-started
+
+	// Act
+	shutdownErr := make(chan error)
+	go func() { shutdownErr <- api.shutdown(server) }()
+	time.Sleep(50 * time.Millisecond)
+	readyWhileDraining := api.isReady()
+	_, dialErr := net.Dial("tcp", listener.Addr().String())
+	release <- true
+
+	// Assert
+	if readyWhileDraining {
+		t.Errorf("API was still ready while draining")
+	}
+	if dialErr == nil {
+		t.Errorf("API accepted a new connection while draining")
+	}
+	if statusCode := <-statusCodes; statusCode != 204 {
+		t.Errorf("request in flight got unexpected status code: got %v, want 204", statusCode)
+	}
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("shutdown returned an unexpected error: %v", err)
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	// Arrange
+	defer viper.Reset()
+	configPath := filepath.Join(t.TempDir(), "plants.yml")
+	os.WriteFile(configPath, []byte("Server:\n  Address: \":9000\"\n  ReadTimeout: 1s\n  IdleTimeout: 1s\n"), 0600)
+	t.Setenv("PLANT_API_SERVER_READTIMEOUT", "2s")
+	t.Setenv("PLANT_API_SERVER_IDLETIMEOUT", "3s")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	addConfigFlags(flags)
+	flags.Parse([]string{"--config", configPath, "--server.idletimeout", "4s"})
+	api := Api{}
+
+	// Act
+	loadConfig(flags)
+	server := api.newServer()
+
+	// Assert
+	if server.Addr != ":9000" {
+		t.Errorf("config file wasn't applied: got address %v, want :9000", server.Addr)
+	}
+	if server.ReadTimeout != 2*time.Second {
+		t.Errorf("environment variable wasn't applied: got read timeout %v, want 2s", server.ReadTimeout)
+	}
+	if server.IdleTimeout != 4*time.Second {
+		t.Errorf("flag wasn't applied: got idle timeout %v, want 4s", server.IdleTimeout)
+	}
+	if server.WriteTimeout != 10*time.Minute || server.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+		t.Errorf("defaults weren't applied: got write timeout %v and max header bytes %v", server.WriteTimeout, server.MaxHeaderBytes)
+	}
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	// Arrange
+	defer viper.Reset()
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(t.TempDir())
+	t.Setenv("PLANT_API_SERVER_ADDRESS", ":9001")
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	addConfigFlags(flags)
+	flags.Parse([]string{"--config", ""})
+	api := Api{}
+
+	// Act
+	loadConfig(flags)
+	server := api.newServer()
+
+	// Assert
+	if server.Addr != ":9001" {
+		t.Errorf("environment variable wasn't applied: got address %v, want :9001", server.Addr)
+	}
+	if server.WriteTimeout != 10*time.Minute {
+		t.Errorf("defaults weren't applied: got write timeout %v", server.WriteTimeout)
+	}
+}
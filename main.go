@@ -1,7 +1,67 @@
 package main
 
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+)
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+
+	flags := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	addConfigFlags(flags)
+	flags.Parse(os.Args[1:])
+
 	api := Api{}
-	api.Initialise()
+	api.Initialise(flags)
 	api.Run()
 }
+
+// runImport imports a CSV file of Plants into the configured database and
+// prints the report, returning the exit code: 1 if the import or any of its
+// rows failed.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would be imported without writing anything")
+	delimiter := flags.String("delimiter", defaultOtherNamesDelimiter, "separator between names in the otherNames column")
+	addConfigFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() != 1 {
+		log.Println("Usage: import [-dry-run] [-delimiter ;] [-config path] <file.csv>")
+		return 2
+	}
+
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		log.Println("Error while opening CSV file: ", err)
+		return 1
+	}
+	defer file.Close()
+
+	api := Api{}
+	loadConfig(flags)
+	api.initialiseDatabase()
+	defer api.disconnectDatabase()
+
+	ctx, cancel := dbContext(context.Background(), dbOperationBatch)
+	defer cancel()
+	report, err := importPlantsCsv(ctx, api.DB, file, ImportOptions{DryRun: *dryRun, OtherNamesDelimiter: *delimiter, Actor: "cli"})
+	if err != nil {
+		log.Println("Error while importing Plants: ", err)
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MemoryDb keeps Plants in maps. Its operations never wait on I/O, so the
+// context is only checked while streaming, which calls back into the caller.
+type MemoryDb struct {
+	mutex     sync.RWMutex
+	plants    map[int]Plant
+	revisions map[int][]PlantRevision
+	lastId    int
+}
+
+func (db *MemoryDb) Connect(ctx context.Context) error {
+	log.Println("Initialising in-memory database...")
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if db.plants == nil {
+		db.plants = make(map[int]Plant)
+		db.revisions = make(map[int][]PlantRevision)
+	}
+	log.Println("Initialised in-memory database.")
+	return nil
+}
+
+func (db *MemoryDb) Disconnect(ctx context.Context) error {
+	log.Println("Closing in-memory database.")
+	return nil
+}
+
+func (db *MemoryDb) Ping(ctx context.Context) error {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+	if db.plants == nil {
+		return errors.New("in-memory database is not initialised")
+	}
+	return nil
+}
+
+func (db *MemoryDb) GetAllPlants(ctx context.Context) ([]Plant, error) {
+	log.Println("Finding all Plants in memory")
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	plants := db.plantsWhere(func(plant Plant) bool { return plant.DeletedAt == nil })
+	log.Println("Retrieved all Plants from memory. Item count: ", len(plants))
+	return plants, nil
+}
+
+func (db *MemoryDb) GetDeletedPlants(ctx context.Context) ([]Plant, error) {
+	log.Println("Finding deleted Plants in memory")
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	plants := db.plantsWhere(func(plant Plant) bool { return plant.DeletedAt != nil })
+	log.Println("Retrieved deleted Plants from memory. Item count: ", len(plants))
+	return plants, nil
+}
+
+func (db *MemoryDb) GetPlants(ctx context.Context, query PlantQuery) ([]Plant, int, error) {
+	log.Printf("Finding Plants in memory with filter %+v, sort %v, limit %v and offset %v\n", query.Filter, query.Sort, query.Limit, query.Offset)
+	plants, err := db.GetAllPlants(ctx)
+	if err != nil {
+		return []Plant{}, 0, err
+	}
+
+	page, total := applyPlantQuery(plants, query)
+	log.Printf("Retrieved Plants from memory. Item count: %v, total: %v\n", len(page), total)
+	return page, total, nil
+}
+
+func (db *MemoryDb) StreamPlants(ctx context.Context, filter PlantFilter, fn func(plant Plant) error) error {
+	log.Printf("Streaming Plants from memory with filter %+v\n", filter)
+	db.mutex.RLock()
+	plants := db.plantsWhere(func(plant Plant) bool { return plant.DeletedAt == nil && filter.Matches(plant) })
+	db.mutex.RUnlock()
+
+	// The lock isn't held while calling fn, which may be slow
+	for _, plant := range plants {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(plant); err != nil {
+			return err
+		}
+	}
+
+	log.Println("Streamed Plants from memory. Item count: ", len(plants))
+	return nil
+}
+
+func (db *MemoryDb) GetPlantById(ctx context.Context, id int) (Plant, error) {
+	log.Printf("Finding Plant in memory with id %v...\n", id)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	plant, ok := db.plants[id]
+	if !ok || plant.DeletedAt != nil {
+		return Plant{}, &NotFoundError{}
+	}
+
+	log.Printf("Retrieved Plant from memory with id %v. Result: %v\n", id, plant.PrettyString())
+	return copyPlant(plant), nil
+}
+
+func (db *MemoryDb) SearchPlants(ctx context.Context, text string, limit int) ([]PlantSearchResult, error) {
+	log.Printf("Searching Plants in memory for '%v'\n", text)
+	plants, err := db.GetAllPlants(ctx)
+	if err != nil {
+		return []PlantSearchResult{}, err
+	}
+
+	results := searchPlants(plants, text, limit)
+	log.Println("Searched Plants in memory. Item count: ", len(results))
+	return results, nil
+}
+
+func (db *MemoryDb) CreatePlant(ctx context.Context, plant Plant, opts WriteOptions) error {
+	log.Printf("Inserting new Plant into memory: %v\n", plant.PrettyString())
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	id, err := db.createPlant(plant, opts)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Inserted Plant into memory. id: ", id)
+	return nil
+}
+
+func (db *MemoryDb) UpsertPlant(ctx context.Context, id int, plant Plant, opts WriteOptions) (int, error) {
+	log.Printf("Upserting Plant with id %v into memory: %v\n", id, plant.PrettyString())
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	if _, err := db.upsertPlant(id, plant, opts); err != nil {
+		return 0, err
+	}
+
+	log.Printf("Upserted Plant into memory with id %v\n", id)
+	return db.plants[id].Version, nil
+}
+
+func (db *MemoryDb) WritePlants(ctx context.Context, writes []PlantWrite, allOrNothing bool, opts WriteOptions) ([]PlantWriteResult, error) {
+	log.Printf("Writing batch of %v Plants into memory\n", len(writes))
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	// Maps are copied so a failed all-or-nothing batch can be undone. Stored
+	// Plants and revisions are never modified in place, so shallow copies do.
+	plants := make(map[int]Plant, len(db.plants))
+	for id, plant := range db.plants {
+		plants[id] = plant
+	}
+	revisions := make(map[int][]PlantRevision, len(db.revisions))
+	for id, history := range db.revisions {
+		revisions[id] = history
+	}
+	lastId := db.lastId
+
+	results := make([]PlantWriteResult, len(writes))
+	for i, write := range writes {
+		if write.Id == 0 {
+			results[i].Id, results[i].Err = db.createPlant(write.Plant, opts)
+			results[i].Created = results[i].Err == nil
+		} else {
+			results[i].Id = write.Id
+			results[i].Created, results[i].Err = db.upsertPlant(write.Id, write.Plant, opts)
+		}
+	}
+	if allOrNothing && rollBackFailedBatch(results) {
+		db.plants, db.revisions, db.lastId = plants, revisions, lastId
+		log.Println("Rolled back batch in memory")
+		return results, nil
+	}
+
+	log.Println("Wrote batch into memory")
+	return results, nil
+}
+
+// createPlant inserts plant with the next id and returns the id. The caller
+// must hold the mutex.
+func (db *MemoryDb) createPlant(plant Plant, opts WriteOptions) (int, error) {
+	if db.nameTaken(plant.Name, 0) {
+		return 0, &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
+	}
+
+	db.lastId++
+	plant.Id = db.lastId
+	plant.Version = 1
+	db.putPlant(RevisionActionCreate, nil, plant, opts)
+	return plant.Id, nil
+}
+
+// upsertPlant stores plant under id and reports whether it was new. The
+// caller must hold the mutex.
+func (db *MemoryDb) upsertPlant(id int, plant Plant, opts WriteOptions) (bool, error) {
+	// Upserting a deleted Plant replaces and restores it
+	existing, exists := db.plants[id]
+	if err := checkVersion(existing, exists && existing.DeletedAt == nil, opts); err != nil {
+		return false, err
+	}
+	if db.nameTaken(plant.Name, id) {
+		return false, &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
+	}
+
+	plant.Id = id
+	plant.DeletedAt = nil
+	plant.Version = existing.Version + 1
+	if exists {
+		db.putPlant(RevisionActionUpdate, &existing, plant, opts)
+	} else {
+		db.putPlant(RevisionActionCreate, nil, plant, opts)
+	}
+	if id > db.lastId {
+		db.lastId = id
+	}
+	return !exists, nil
+}
+
+func (db *MemoryDb) PatchPlant(ctx context.Context, id int, changes map[string]interface{}, opts WriteOptions) (int, error) {
+	log.Printf("Patching Plant with id %v in memory: %v\n", id, changes)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	existing, exists := db.plants[id]
+	exists = exists && existing.DeletedAt == nil
+	if err := checkVersion(existing, exists, opts); err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, &NotFoundError{}
+	}
+	plant, err := applyPlantChanges(existing, changes)
+	if err != nil {
+		return 0, err
+	}
+	if db.nameTaken(plant.Name, id) {
+		return 0, &ConflictError{ConflictingKey: "name", ConflictingValue: plant.Name}
+	}
+	plant.Version = existing.Version + 1
+	db.putPlant(RevisionActionUpdate, &existing, plant, opts)
+
+	log.Printf("Patched Plant in memory with id %v\n", id)
+	return plant.Version, nil
+}
+
+func (db *MemoryDb) DeletePlant(ctx context.Context, id int, opts WriteOptions) error {
+	log.Printf("Deleting Plant with id %v in memory\n", id)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	existing, exists := db.plants[id]
+	exists = exists && existing.DeletedAt == nil
+	if err := checkVersion(existing, exists, opts); err != nil {
+		return err
+	}
+	deletedCount := 0
+	if exists {
+		deleted := copyPlant(existing)
+		deletedAt := time.Now().UTC()
+		deleted.DeletedAt = &deletedAt
+		deleted.Version++
+		db.putPlant(RevisionActionDelete, &existing, deleted, opts)
+		deletedCount = 1
+	}
+
+	log.Printf("Deleted Plant in memory. DeletedCount: %v\n", deletedCount)
+	return nil
+}
+
+func (db *MemoryDb) RestorePlant(ctx context.Context, id int, opts WriteOptions) (int, error) {
+	log.Printf("Restoring Plant with id %v in memory\n", id)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	existing, exists := db.plants[id]
+	if !exists || existing.DeletedAt == nil {
+		return 0, &NotFoundError{}
+	}
+	if db.nameTaken(existing.Name, id) {
+		return 0, &ConflictError{ConflictingKey: "name", ConflictingValue: existing.Name}
+	}
+	restored := copyPlant(existing)
+	restored.DeletedAt = nil
+	restored.Version++
+	db.putPlant(RevisionActionRestore, &existing, restored, opts)
+
+	log.Printf("Restored Plant in memory with id %v\n", id)
+	return restored.Version, nil
+}
+
+func (db *MemoryDb) PurgePlant(ctx context.Context, id int) error {
+	log.Printf("Purging Plant with id %v in memory\n", id)
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	existing, exists := db.plants[id]
+	if !exists || existing.DeletedAt == nil {
+		return &NotFoundError{}
+	}
+	// Purging is permanent, so the history goes too
+	delete(db.plants, id)
+	delete(db.revisions, id)
+
+	log.Printf("Purged Plant in memory with id %v\n", id)
+	return nil
+}
+
+func (db *MemoryDb) GetPlantHistory(ctx context.Context, id int) ([]PlantRevision, error) {
+	log.Printf("Finding history of Plant with id %v in memory\n", id)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	revisions := make([]PlantRevision, 0, len(db.revisions[id]))
+	for _, revision := range db.revisions[id] {
+		revisions = append(revisions, copyRevision(revision))
+	}
+
+	log.Println("Retrieved history from memory. Item count: ", len(revisions))
+	return revisions, nil
+}
+
+func (db *MemoryDb) GetPlantRevision(ctx context.Context, id int, revision int) (PlantRevision, error) {
+	log.Printf("Finding revision %v of Plant with id %v in memory\n", revision, id)
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	for _, existing := range db.revisions[id] {
+		if existing.Revision == revision {
+			return copyRevision(existing), nil
+		}
+	}
+	return PlantRevision{}, &NotFoundError{}
+}
+
+// putPlant stores after and records the write in its history. The caller
+// must hold the mutex.
+func (db *MemoryDb) putPlant(action string, before *Plant, after Plant, opts WriteOptions) {
+	db.plants[after.Id] = copyPlant(after)
+	revision := copyRevision(newRevision(action, before, after, opts))
+	db.revisions[after.Id] = append(db.revisions[after.Id], revision)
+}
+
+// plantsWhere returns copies of the stored Plants matching include, in id
+// order. The caller must hold the mutex.
+func (db *MemoryDb) plantsWhere(include func(plant Plant) bool) []Plant {
+	plants := make([]Plant, 0, len(db.plants))
+	for _, plant := range db.plants {
+		if include(plant) {
+			plants = append(plants, copyPlant(plant))
+		}
+	}
+	sort.Slice(plants, func(i, j int) bool { return plants[i].Id < plants[j].Id })
+	return plants
+}
+
+// nameTaken reports whether a Plant other than the one with the given id
+// already uses name, mirroring the unique index on name in MongoDB. Deleted
+// Plants don't hold on to their names.
+func (db *MemoryDb) nameTaken(name string, id int) bool {
+	for _, existing := range db.plants {
+		if existing.Name == name && existing.Id != id && existing.DeletedAt == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func copyRevision(revision PlantRevision) PlantRevision {
+	for _, plant := range []**Plant{&revision.Before, &revision.After} {
+		if *plant != nil {
+			copied := copyPlant(**plant)
+			*plant = &copied
+		}
+	}
+	return revision
+}
+
+// copyPlant returns a Plant which shares no slices with the original, so
+// stored records can't be modified by callers.
+func copyPlant(plant Plant) Plant {
+	if plant.OtherNames != nil {
+		plant.OtherNames = append([]string{}, plant.OtherNames...)
+	}
+	if plant.DeletedAt != nil {
+		deletedAt := *plant.DeletedAt
+		plant.DeletedAt = &deletedAt
+	}
+	return plant
+}
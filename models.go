@@ -3,48 +3,159 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 )
 
 // --------------- Request/response ---------------
 
+// Lists are wrapped in an element of their own in XML, except optional ones,
+// which are repeated elements so they can be left out when empty.
+
 type PlantRequest struct {
-	Name       string   `json:"name"`
-	OtherNames []string `json:"otherNames"`
-	Light      string   `json:"light"`
-	Humidity   string   `json:"humidity"`
-	Water      string   `json:"water"`
+	Name       string        `json:"name" xml:"name" yaml:"name"`
+	OtherNames []string      `json:"otherNames" xml:"otherNames>otherName" yaml:"otherNames"`
+	Light      LightLevel    `json:"light" xml:"light" yaml:"light"`
+	Humidity   HumidityLevel `json:"humidity" xml:"humidity" yaml:"humidity"`
+	Water      WaterLevel    `json:"water" xml:"water" yaml:"water"`
 }
 
-func (plant *PlantRequest) Validate() []string {
-	results := make([]string, 0)
+// Validate returns an error for each field of the request which is invalid.
+func (plant *PlantRequest) Validate() []FieldError {
+	results := make([]FieldError, 0)
 	if len(plant.Name) == 0 {
-		results = append(results, "The name value is required")
-	}
-	if len(plant.Light) == 0 {
-		results = append(results, "The light value is required")
-	}
-	if len(plant.Humidity) == 0 {
-		results = append(results, "The humidity value is required")
+		results = append(results, requiredFieldError("name"))
 	}
-	if len(plant.Water) == 0 {
-		results = append(results, "The water value is required")
+	for _, field := range levelFields(plant.Light, plant.Humidity, plant.Water) {
+		if len(field.value) == 0 {
+			results = append(results, requiredFieldError(field.name))
+		} else if !field.valid {
+			results = append(results, FieldError{
+				Field:   field.name,
+				Code:    fieldErrorInvalidValue,
+				Message: vocabularyMessage(field.name, field.vocabulary),
+			})
+		}
 	}
 	return results
 }
 
+func requiredFieldError(field string) FieldError {
+	return FieldError{Field: field, Code: fieldErrorRequired, Message: fmt.Sprintf("The %v value is required", field)}
+}
+
+type CreatePlantResponse struct {
+	Warnings []string `json:"warnings,omitempty" xml:"warning,omitempty" yaml:"warnings,omitempty"`
+}
+
+// BatchPlantRequest is one item of a batch. It is upserted when it has an
+// id, otherwise it is created.
+type BatchPlantRequest struct {
+	Id           int `json:"id,omitempty" xml:"id,omitempty" yaml:"id,omitempty"`
+	PlantRequest `yaml:",inline"`
+}
+
+type BatchResponse struct {
+	Mode    string            `json:"mode" xml:"mode" yaml:"mode"`
+	Results []BatchItemResult `json:"results" xml:"results>result" yaml:"results"`
+}
+
+// BatchItemResult is the outcome of the batch item at Index, with the HTTP
+// status the item would have had on its own.
+type BatchItemResult struct {
+	Index  int          `json:"index" xml:"index" yaml:"index"`
+	Status int          `json:"status" xml:"status" yaml:"status"`
+	Id     int          `json:"id,omitempty" xml:"id,omitempty" yaml:"id,omitempty"`
+	Code   string       `json:"code,omitempty" xml:"code,omitempty" yaml:"code,omitempty"`
+	Detail string       `json:"detail,omitempty" xml:"detail,omitempty" yaml:"detail,omitempty"`
+	Errors []FieldError `json:"errors,omitempty" xml:"error,omitempty" yaml:"errors,omitempty"`
+}
+
+// ImportReport says what a CSV import did, or would do in a dry run, with
+// each row of the file.
+type ImportReport struct {
+	DryRun  bool              `json:"dryRun" xml:"dryRun" yaml:"dryRun"`
+	Created int               `json:"created" xml:"created" yaml:"created"`
+	Updated int               `json:"updated" xml:"updated" yaml:"updated"`
+	Skipped int               `json:"skipped" xml:"skipped" yaml:"skipped"`
+	Failed  int               `json:"failed" xml:"failed" yaml:"failed"`
+	Rows    []ImportRowResult `json:"rows" xml:"rows>row" yaml:"rows"`
+}
+
+type ImportRowResult struct {
+	Row    int          `json:"row" xml:"row" yaml:"row"`
+	Status string       `json:"status" xml:"status" yaml:"status"`
+	Id     int          `json:"id,omitempty" xml:"id,omitempty" yaml:"id,omitempty"`
+	Name   string       `json:"name,omitempty" xml:"name,omitempty" yaml:"name,omitempty"`
+	Errors []FieldError `json:"errors,omitempty" xml:"error,omitempty" yaml:"errors,omitempty"`
+}
+
+type PlantListResponse struct {
+	Items  []Plant   `json:"items" xml:"items>plant" yaml:"items"`
+	Total  int       `json:"total" xml:"total" yaml:"total"`
+	Limit  int       `json:"limit" xml:"limit" yaml:"limit"`
+	Offset int       `json:"offset" xml:"offset" yaml:"offset"`
+	Links  PageLinks `json:"links" xml:"links" yaml:"links"`
+}
+
+type PageLinks struct {
+	Next string `json:"next,omitempty" xml:"next,omitempty" yaml:"next,omitempty"`
+	Prev string `json:"prev,omitempty" xml:"prev,omitempty" yaml:"prev,omitempty"`
+}
+
+// VocabularyResponse lists the values allowed for each level of a Plant.
+type VocabularyResponse struct {
+	Light    []string `json:"light" xml:"light>value" yaml:"light"`
+	Humidity []string `json:"humidity" xml:"humidity>value" yaml:"humidity"`
+	Water    []string `json:"water" xml:"water>value" yaml:"water"`
+}
+
+// HealthResponse says whether the API is up or, for readiness, able to serve
+// requests, along with the state of each dependency it checked.
+type HealthResponse struct {
+	Status string             `json:"status" xml:"status" yaml:"status"`
+	Checks []DependencyHealth `json:"checks,omitempty" xml:"check,omitempty" yaml:"checks,omitempty"`
+}
+
+// DependencyHealth is the state of one dependency and how long it took to
+// check, in milliseconds.
+type DependencyHealth struct {
+	Name      string  `json:"name" xml:"name" yaml:"name"`
+	Status    string  `json:"status" xml:"status" yaml:"status"`
+	LatencyMs float64 `json:"latencyMs" xml:"latencyMs" yaml:"latencyMs"`
+	Error     string  `json:"error,omitempty" xml:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// ErrorResponse is an RFC 7807 problem details document. Errors lists the
+// individual fields at fault, when there are any.
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Type   string       `json:"type" xml:"type" yaml:"type"`
+	Title  string       `json:"title" xml:"title" yaml:"title"`
+	Status int          `json:"status" xml:"status" yaml:"status"`
+	Detail string       `json:"detail" xml:"detail" yaml:"detail"`
+	Code   string       `json:"code" xml:"code" yaml:"code"`
+	Errors []FieldError `json:"errors,omitempty" xml:"error,omitempty" yaml:"errors,omitempty"`
+}
+
+// FieldError is a problem with a single field of a request. Pointer is the
+// RFC 6901 JSON Pointer to the value at fault, when it's known.
+type FieldError struct {
+	Field   string `json:"field" xml:"field" yaml:"field"`
+	Pointer string `json:"pointer,omitempty" xml:"pointer,omitempty" yaml:"pointer,omitempty"`
+	Code    string `json:"code" xml:"code" yaml:"code"`
+	Message string `json:"message" xml:"message" yaml:"message"`
 }
 
 // --------------- Domain ---------------
 
 type Plant struct {
-	Id         int      `json:"id"`
-	Name       string   `json:"name"`
-	OtherNames []string `json:"otherNames"`
-	Light      string   `json:"light"`
-	Humidity   string   `json:"humidity"`
-	Water      string   `json:"water"`
+	Id         int           `json:"id" xml:"id" yaml:"id" bson:"id"`
+	Name       string        `json:"name" xml:"name" yaml:"name" bson:"name"`
+	OtherNames []string      `json:"otherNames" xml:"otherNames>otherName" yaml:"otherNames" bson:"otherNames"`
+	Light      LightLevel    `json:"light" xml:"light" yaml:"light" bson:"light"`
+	Humidity   HumidityLevel `json:"humidity" xml:"humidity" yaml:"humidity" bson:"humidity"`
+	Water      WaterLevel    `json:"water" xml:"water" yaml:"water" bson:"water"`
+	Version    int           `json:"version,omitempty" xml:"version,omitempty" yaml:"version,omitempty" bson:"version"`
+	DeletedAt  *time.Time    `json:"deletedAt,omitempty" xml:"deletedAt,omitempty" yaml:"deletedAt,omitempty" bson:"deletedAt"`
 }
 
 func (plant *Plant) PrettyString() string {
@@ -52,6 +163,37 @@ func (plant *Plant) PrettyString() string {
 		plant.Id, plant.Name, strings.Join(plant.OtherNames, ", "), plant.Light, plant.Humidity, plant.Water)
 }
 
+const (
+	RevisionActionCreate  = "create"
+	RevisionActionUpdate  = "update"
+	RevisionActionDelete  = "delete"
+	RevisionActionRestore = "restore"
+)
+
+// PlantRevision records a single write to a Plant. Its revision number is
+// the version of the Plant after the write.
+type PlantRevision struct {
+	PlantId   int       `json:"plantId" xml:"plantId" yaml:"plantId" bson:"plantId"`
+	Revision  int       `json:"revision" xml:"revision" yaml:"revision" bson:"revision"`
+	Action    string    `json:"action" xml:"action" yaml:"action" bson:"action"`
+	Timestamp time.Time `json:"timestamp" xml:"timestamp" yaml:"timestamp" bson:"timestamp"`
+	Actor     string    `json:"actor" xml:"actor" yaml:"actor" bson:"actor"`
+	Before    *Plant    `json:"before" xml:"before" yaml:"before" bson:"before"`
+	After     *Plant    `json:"after" xml:"after" yaml:"after" bson:"after"`
+}
+
+type PlantSearchResult struct {
+	Plant `yaml:",inline"`
+	Score float64 `json:"score" xml:"score" yaml:"score"`
+}
+
+type PlantNameSuggestion struct {
+	Id          int     `json:"id" xml:"id" yaml:"id"`
+	Name        string  `json:"name" xml:"name" yaml:"name"`
+	MatchedName string  `json:"matchedName" xml:"matchedName" yaml:"matchedName"`
+	Score       float64 `json:"score" xml:"score" yaml:"score"`
+}
+
 // --------------- Errors ---------------
 
 type NotFoundError struct{}
@@ -69,3 +211,15 @@ func (err *ConflictError) Error() string {
 	return fmt.Sprintf("the request conflicts with the target resource (conflicting key: %v, conflicting value: %v)",
 		err.ConflictingKey, err.ConflictingValue)
 }
+
+type PreconditionFailedError struct{}
+
+func (err *PreconditionFailedError) Error() string {
+	return "the stored record does not match the expected version"
+}
+
+type RolledBackError struct{}
+
+func (err *RolledBackError) Error() string {
+	return "the write was rolled back because another write in the batch failed"
+}
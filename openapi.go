@@ -0,0 +1,504 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The OpenAPI document is built from apiOperations, with the schemas of its
+// bodies generated from the Go types, so they can't drift from the JSON the
+// handlers actually write.
+type openApiDocument struct {
+	OpenApi    string                                  `json:"openapi"`
+	Info       openApiInfo                             `json:"info"`
+	Paths      map[string]map[string]*openApiOperation `json:"paths"`
+	Components openApiComponents                       `json:"components"`
+}
+
+type openApiInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type openApiComponents struct {
+	Schemas map[string]*openApiSchema `json:"schemas"`
+}
+
+type openApiOperation struct {
+	OperationId string                      `json:"operationId"`
+	Summary     string                      `json:"summary"`
+	Parameters  []openApiParameter          `json:"parameters,omitempty"`
+	RequestBody *openApiRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openApiResponse `json:"responses"`
+}
+
+type openApiParameter struct {
+	Name        string         `json:"name"`
+	In          string         `json:"in"`
+	Description string         `json:"description,omitempty"`
+	Required    bool           `json:"required,omitempty"`
+	Schema      *openApiSchema `json:"schema"`
+}
+
+type openApiRequestBody struct {
+	Required bool                         `json:"required"`
+	Content  map[string]*openApiMediaType `json:"content"`
+}
+
+type openApiResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*openApiMediaType `json:"content,omitempty"`
+}
+
+type openApiMediaType struct {
+	Schema *openApiSchema `json:"schema"`
+}
+
+type openApiSchema struct {
+	Ref        string                    `json:"$ref,omitempty"`
+	Type       string                    `json:"type,omitempty"`
+	Format     string                    `json:"format,omitempty"`
+	Enum       []string                  `json:"enum,omitempty"`
+	Items      *openApiSchema            `json:"items,omitempty"`
+	Properties map[string]*openApiSchema `json:"properties,omitempty"`
+	Required   []string                  `json:"required,omitempty"`
+	OneOf      []*openApiSchema          `json:"oneOf,omitempty"`
+	Nullable   bool                      `json:"nullable,omitempty"`
+}
+
+// apiOperation documents a route registered in initialiseRouter. Bodies are
+// given as example values of the Go types they're encoded from, or a slice
+// of them when there are alternatives. Responses without a body have nil.
+type apiOperation struct {
+	method      string
+	path        string
+	id          string
+	summary     string
+	parameters  []openApiParameter
+	requestBody interface{}
+	// requestTypes overrides the content types of the request body, which
+	// are otherwise those of the codecs.
+	requestTypes map[string]interface{}
+	responses    map[int]interface{}
+	// responseTypes overrides the content types of the success responses.
+	responseTypes map[string]interface{}
+}
+
+// problem stands for an ErrorResponse in apiOperation responses.
+var problem = ErrorResponse{}
+
+var (
+	plantIdParameter     = openApiParameter{Name: "id", In: "path", Description: "The id of the Plant", Required: true, Schema: &openApiSchema{Type: "integer"}}
+	revisionParameter    = openApiParameter{Name: "rev", In: "path", Description: "The revision number, which is the version of the Plant after the write", Required: true, Schema: &openApiSchema{Type: "integer"}}
+	limitParameter       = openApiParameter{Name: "limit", In: "query", Description: fmt.Sprintf("The most results to return, between 1 and %v", maxPageLimit), Schema: &openApiSchema{Type: "integer"}}
+	ifMatchParameter     = openApiParameter{Name: "If-Match", In: "header", Description: "Only write if the Plant still has one of these ETags", Schema: &openApiSchema{Type: "string"}}
+	ifNoneMatchParameter = openApiParameter{Name: "If-None-Match", In: "header", Description: "Respond with 304 if the Plant still has one of these ETags", Schema: &openApiSchema{Type: "string"}}
+	clientIdParameter    = openApiParameter{Name: "X-Client-Id", In: "header", Description: "Identifies the client in the history of the Plants it changes", Schema: &openApiSchema{Type: "string"}}
+	filterParameters     = []openApiParameter{
+		{Name: "name", In: "query", Description: "Only Plants with this name, or whose name starts with it when it ends in *", Schema: &openApiSchema{Type: "string"}},
+		{Name: "light", In: "query", Description: "Only Plants with this light level", Schema: &openApiSchema{Type: "string", Enum: lightVocabulary}},
+		{Name: "humidity", In: "query", Description: "Only Plants with this humidity level", Schema: &openApiSchema{Type: "string", Enum: humidityVocabulary}},
+		{Name: "water", In: "query", Description: "Only Plants with this water level", Schema: &openApiSchema{Type: "string", Enum: waterVocabulary}},
+	}
+)
+
+var apiOperations = []apiOperation{
+	{
+		method: "GET", path: "/openapi.json", id: "getOpenApiSpec",
+		summary:       "Describe the API as an OpenAPI 3 document",
+		responses:     map[int]interface{}{200: nil},
+		responseTypes: map[string]interface{}{"application/json": map[string]interface{}{}},
+	},
+	{
+		method: "GET", path: "/healthz", id: "getHealth",
+		summary:   "Check that the API is alive",
+		responses: map[int]interface{}{200: HealthResponse{}},
+	},
+	{
+		method: "GET", path: "/readyz", id: "getReadiness",
+		summary:   "Check that the API and the database it depends on can serve requests",
+		responses: map[int]interface{}{200: HealthResponse{}, 503: HealthResponse{}},
+	},
+	{
+		method: "GET", path: "/vocabulary", id: "getVocabulary",
+		summary:   "List the values allowed for each level of a Plant",
+		responses: map[int]interface{}{200: VocabularyResponse{}, 406: problem},
+	},
+	{
+		method: "GET", path: "/plants", id: "listPlants",
+		summary: "List a page of Plants",
+		parameters: append([]openApiParameter{
+			limitParameter,
+			{Name: "offset", In: "query", Description: "The number of Plants to skip", Schema: &openApiSchema{Type: "integer"}},
+			{Name: "sort", In: "query", Description: "Comma separated fields to sort by, each descending when prefixed with -", Schema: &openApiSchema{Type: "string"}},
+		}, filterParameters...),
+		responses: map[int]interface{}{200: PlantListResponse{}, 400: problem, 406: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "GET", path: "/plants/export", id: "exportPlants",
+		summary: "Export every Plant matching the filters",
+		parameters: append([]openApiParameter{
+			{Name: "format", In: "query", Description: "The format of the export, json by default", Schema: &openApiSchema{Type: "string", Enum: []string{exportFormatCsv, exportFormatNdjson, exportFormatJson}}},
+		}, filterParameters...),
+		responses: map[int]interface{}{200: nil, 400: problem, 500: problem, 503: problem, 504: problem},
+		responseTypes: map[string]interface{}{
+			exportContentTypes[exportFormatCsv]:    "",
+			exportContentTypes[exportFormatNdjson]: "",
+			exportContentTypes[exportFormatJson]:   []Plant{},
+		},
+	},
+	{
+		method: "GET", path: "/plants/search", id: "searchPlants",
+		summary: "Search the names of Plants, best match first",
+		parameters: []openApiParameter{
+			{Name: "q", In: "query", Description: "The text to search for", Required: true, Schema: &openApiSchema{Type: "string"}},
+			limitParameter,
+		},
+		responses: map[int]interface{}{200: []PlantSearchResult{}, 400: problem, 406: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "GET", path: "/plants/suggest", id: "suggestPlants",
+		summary: "Suggest the names of Plants closest to a possibly misspelt name",
+		parameters: []openApiParameter{
+			{Name: "name", In: "query", Description: "The name to find suggestions for", Required: true, Schema: &openApiSchema{Type: "string"}},
+			limitParameter,
+		},
+		responses: map[int]interface{}{200: []PlantNameSuggestion{}, 400: problem, 406: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "GET", path: "/plants/trash", id: "listTrash",
+		summary:   "List the deleted Plants",
+		responses: map[int]interface{}{200: []Plant{}, 406: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "DELETE", path: "/plants/trash/{id}", id: "purgePlant",
+		summary: "Permanently delete a deleted Plant and its history",
+		parameters: []openApiParameter{
+			plantIdParameter,
+			{Name: "X-Admin-Key", In: "header", Description: "The admin key from config", Required: true, Schema: &openApiSchema{Type: "string"}},
+		},
+		responses: map[int]interface{}{204: nil, 400: problem, 403: problem, 404: problem, 406: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "GET", path: "/plants/{id}", id: "getPlant",
+		summary: "Get a Plant",
+		parameters: []openApiParameter{
+			plantIdParameter,
+			ifNoneMatchParameter,
+		},
+		responses: map[int]interface{}{200: Plant{}, 304: nil, 400: problem, 404: problem, 406: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "GET", path: "/plants/by-slug/{slug}", id: "getPlantBySlug",
+		summary: "Get a Plant by the slug of its name, such as dracaena-marginata",
+		parameters: []openApiParameter{
+			{Name: "slug", In: "path", Description: "The name of the Plant in lower case, with hyphens between its words", Required: true, Schema: &openApiSchema{Type: "string"}},
+			ifNoneMatchParameter,
+		},
+		responses: map[int]interface{}{200: Plant{}, 304: nil, 400: problem, 404: problem, 406: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "POST", path: "/plants", id: "createPlant",
+		summary:     "Create a Plant",
+		parameters:  []openApiParameter{clientIdParameter},
+		requestBody: PlantRequest{},
+		responses:   map[int]interface{}{201: CreatePlantResponse{}, 400: problem, 406: problem, 409: problem, 415: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "POST", path: "/plants:batch", id: "writePlantBatch",
+		summary: "Create or upsert many Plants",
+		parameters: []openApiParameter{
+			{Name: "mode", In: "query", Description: "Whether a failed item stops the whole batch being written", Schema: &openApiSchema{Type: "string", Enum: []string{batchModeAllOrNothing, batchModeBestEffort}}},
+			clientIdParameter,
+		},
+		requestBody: []BatchPlantRequest{},
+		// A failed all-or-nothing batch has the status of its first failed item
+		responses: map[int]interface{}{
+			200: BatchResponse{}, 207: BatchResponse{}, 400: []interface{}{BatchResponse{}, problem}, 406: problem,
+			409: BatchResponse{}, 415: problem, 500: []interface{}{BatchResponse{}, problem}, 503: problem, 504: problem,
+		},
+	},
+	{
+		method: "POST", path: "/plants:import", id: "importPlants",
+		summary: "Create and update Plants from a CSV file",
+		parameters: []openApiParameter{
+			{Name: "dryRun", In: "query", Description: "Report what would be imported without writing anything", Schema: &openApiSchema{Type: "boolean"}},
+			{Name: "delimiter", In: "query", Description: fmt.Sprintf("The separator between names in the otherNames column, %v by default", defaultOtherNamesDelimiter), Schema: &openApiSchema{Type: "string"}},
+			clientIdParameter,
+		},
+		requestTypes: map[string]interface{}{csvContentType: ""},
+		responses:    map[int]interface{}{200: ImportReport{}, 400: problem, 406: problem, 415: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "PUT", path: "/plants/{id}", id: "upsertPlant",
+		summary:     "Create or replace a Plant",
+		parameters:  []openApiParameter{plantIdParameter, ifMatchParameter, clientIdParameter},
+		requestBody: PlantRequest{},
+		responses:   map[int]interface{}{200: map[string]string{}, 400: problem, 406: problem, 409: problem, 412: problem, 415: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "PATCH", path: "/plants/{id}", id: "patchPlant",
+		summary:    "Change some fields of a Plant",
+		parameters: []openApiParameter{plantIdParameter, ifMatchParameter, clientIdParameter},
+		requestTypes: map[string]interface{}{
+			mergePatchContentType: map[string]interface{}{},
+			jsonPatchContentType:  []JsonPatchOperation{},
+		},
+		responses: map[int]interface{}{200: map[string]string{}, 400: problem, 404: problem, 406: problem, 409: problem, 412: problem, 415: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "DELETE", path: "/plants/{id}", id: "deletePlant",
+		summary:    "Move a Plant to the trash",
+		parameters: []openApiParameter{plantIdParameter, ifMatchParameter, clientIdParameter},
+		responses:  map[int]interface{}{204: nil, 400: problem, 406: problem, 412: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "POST", path: "/plants/{id}/restore", id: "restorePlant",
+		summary:    "Restore a Plant from the trash",
+		parameters: []openApiParameter{plantIdParameter, clientIdParameter},
+		responses:  map[int]interface{}{200: map[string]string{}, 400: problem, 404: problem, 406: problem, 409: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "GET", path: "/plants/{id}/history", id: "getPlantHistory",
+		summary:    "List every revision of a Plant, oldest first",
+		parameters: []openApiParameter{plantIdParameter},
+		responses:  map[int]interface{}{200: []PlantRevision{}, 400: problem, 404: problem, 406: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "GET", path: "/plants/{id}/history/{rev}", id: "getPlantRevision",
+		summary:    "Get a revision of a Plant",
+		parameters: []openApiParameter{plantIdParameter, revisionParameter},
+		responses:  map[int]interface{}{200: PlantRevision{}, 400: problem, 404: problem, 406: problem, 500: problem, 503: problem, 504: problem},
+	},
+	{
+		method: "POST", path: "/plants/{id}/history/{rev}/revert", id: "revertPlant",
+		summary:    "Write a Plant back as it was after a revision",
+		parameters: []openApiParameter{plantIdParameter, revisionParameter, ifMatchParameter, clientIdParameter},
+		responses:  map[int]interface{}{200: map[string]string{}, 400: problem, 404: problem, 406: problem, 409: problem, 412: problem, 500: problem, 503: problem, 504: problem},
+	},
+}
+
+// openApiRequired lists the required fields of request types, where they
+// aren't simply the fields without omitempty.
+var openApiRequired = map[reflect.Type][]string{
+	reflect.TypeOf(PlantRequest{}):       {"name", "light", "humidity", "water"},
+	reflect.TypeOf(BatchPlantRequest{}):  {"name", "light", "humidity", "water"},
+	reflect.TypeOf(JsonPatchOperation{}): {"op", "path"},
+}
+
+var openApiEnums = map[reflect.Type][]string{
+	reflect.TypeOf(LightLevel("")):    lightVocabulary,
+	reflect.TypeOf(HumidityLevel("")): humidityVocabulary,
+	reflect.TypeOf(WaterLevel("")):    waterVocabulary,
+}
+
+func (api *Api) getOpenApiSpec(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(200)
+	json.NewEncoder(w).Encode(newOpenApiDocument())
+}
+
+// getDocs serves a page which renders the OpenAPI document with Swagger UI.
+// It's only routed when OpenApi.DocsUi is set in config.
+func (api *Api) getDocs(w http.ResponseWriter, r *http.Request) {
+	log.Printf("GET %v\n", r.RequestURI)
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.WriteHeader(200)
+	fmt.Fprint(w, docsPage)
+}
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>Simple Plant API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="docs"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#docs"});</script>
+</body>
+</html>
+`
+
+func newOpenApiDocument() openApiDocument {
+	document := openApiDocument{
+		OpenApi:    "3.0.3",
+		Info:       openApiInfo{Title: "Simple Plant API", Version: "1.0.0"},
+		Paths:      make(map[string]map[string]*openApiOperation),
+		Components: openApiComponents{Schemas: make(map[string]*openApiSchema)},
+	}
+	schemas := document.Components.Schemas
+
+	for _, op := range apiOperations {
+		operation := &openApiOperation{
+			OperationId: op.id,
+			Summary:     op.summary,
+			Parameters:  op.parameters,
+			Responses:   make(map[string]*openApiResponse),
+		}
+		if op.requestBody != nil || op.requestTypes != nil {
+			content := op.requestTypes
+			if content == nil {
+				content = codecContent(op.requestBody)
+			}
+			operation.RequestBody = &openApiRequestBody{Required: true, Content: mediaTypes(content, schemas)}
+			// validateRequests caps the size of every request body
+			operation.Responses["413"] = &openApiResponse{Description: http.StatusText(413), Content: mediaTypes(codecContent(problem), schemas)}
+		}
+		for status, body := range op.responses {
+			response := &openApiResponse{Description: http.StatusText(status)}
+			switch {
+			case status < 300 && op.responseTypes != nil:
+				response.Content = mediaTypes(op.responseTypes, schemas)
+			case body != nil:
+				response.Content = mediaTypes(codecContent(body), schemas)
+			}
+			operation.Responses[fmt.Sprint(status)] = response
+		}
+
+		if document.Paths[op.path] == nil {
+			document.Paths[op.path] = make(map[string]*openApiOperation)
+		}
+		document.Paths[op.path][strings.ToLower(op.method)] = operation
+	}
+	return document
+}
+
+// codecContent gives body under the content type of each codec, which for
+// problems is the codec's problem content type. When body is a slice of
+// alternatives, content types shared by several have a slice of them.
+func codecContent(body interface{}) map[string]interface{} {
+	alternatives, ok := body.([]interface{})
+	if !ok {
+		alternatives = []interface{}{body}
+	}
+	content := make(map[string]interface{})
+	for _, alternative := range alternatives {
+		for _, c := range codecs {
+			contentType := c.contentType()
+			if _, ok := alternative.(ErrorResponse); ok {
+				contentType = c.problemContentType
+			}
+			if existing, ok := content[contentType]; ok {
+				existingAlternatives, ok := existing.([]interface{})
+				if !ok {
+					existingAlternatives = []interface{}{existing}
+				}
+				content[contentType] = append(existingAlternatives, alternative)
+			} else {
+				content[contentType] = alternative
+			}
+		}
+	}
+	return content
+}
+
+func mediaTypes(content map[string]interface{}, schemas map[string]*openApiSchema) map[string]*openApiMediaType {
+	result := make(map[string]*openApiMediaType)
+	for contentType, body := range content {
+		result[contentType] = &openApiMediaType{Schema: bodySchema(body, schemas)}
+	}
+	return result
+}
+
+// bodySchema is the schema of an example body, where a slice of interfaces
+// means any one of its elements.
+func bodySchema(body interface{}, schemas map[string]*openApiSchema) *openApiSchema {
+	if alternatives, ok := body.([]interface{}); ok {
+		schema := &openApiSchema{}
+		for _, alternative := range alternatives {
+			schema.OneOf = append(schema.OneOf, bodySchema(alternative, schemas))
+		}
+		return schema
+	}
+	return typeSchema(reflect.TypeOf(body), schemas)
+}
+
+// typeSchema returns the schema of the JSON encoding of t. Named structs are
+// added to schemas and referred to by name.
+func typeSchema(t reflect.Type, schemas map[string]*openApiSchema) *openApiSchema {
+	if t == nil {
+		return &openApiSchema{}
+	}
+	if enum, ok := openApiEnums[t]; ok {
+		return &openApiSchema{Type: "string", Enum: enum}
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return &openApiSchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return typeSchema(t.Elem(), schemas)
+	case reflect.String:
+		return &openApiSchema{Type: "string"}
+	case reflect.Bool:
+		return &openApiSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int64:
+		return &openApiSchema{Type: "integer"}
+	case reflect.Float64:
+		return &openApiSchema{Type: "number"}
+	case reflect.Slice:
+		return &openApiSchema{Type: "array", Items: typeSchema(t.Elem(), schemas)}
+	case reflect.Map:
+		return &openApiSchema{Type: "object"}
+	case reflect.Struct:
+		ref := &openApiSchema{Ref: "#/components/schemas/" + t.Name()}
+		if _, ok := schemas[t.Name()]; ok {
+			return ref
+		}
+		schema := &openApiSchema{Type: "object", Properties: make(map[string]*openApiSchema)}
+		// Claim the name first, in case the type refers to itself
+		schemas[t.Name()] = schema
+		required := addStructProperties(schema, t, schemas)
+		if override, ok := openApiRequired[t]; ok {
+			required = override
+		}
+		sort.Strings(required)
+		schema.Required = required
+		// Optional lists may be sent as null, which decodes to an empty list
+		for name, property := range schema.Properties {
+			if i := sort.SearchStrings(required, name); property.Type == "array" && (i == len(required) || required[i] != name) {
+				property.Nullable = true
+			}
+		}
+		return ref
+	default:
+		return &openApiSchema{}
+	}
+}
+
+// addStructProperties adds the fields of t to schema, including those of
+// embedded structs, returning the names of those without omitempty.
+func addStructProperties(schema *openApiSchema, t reflect.Type, schemas map[string]*openApiSchema) []string {
+	required := make([]string, 0)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if field.Anonymous && tag == "" {
+			required = append(required, addStructProperties(schema, field.Type, schemas)...)
+			continue
+		}
+		parts := strings.SplitN(tag, ",", 2)
+		name := parts[0]
+		if name == "-" || field.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		schema.Properties[name] = typeSchema(field.Type, schemas)
+		if len(parts) == 1 || parts[1] != "omitempty" {
+			required = append(required, name)
+		}
+	}
+	return required
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	mergePatchContentType = "application/merge-patch+json"
+	jsonPatchContentType  = "application/json-patch+json"
+)
+
+type JsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+// PatchTestFailedError is returned when a JSON Patch test operation doesn't
+// match the target document.
+type PatchTestFailedError struct {
+	Path string
+}
+
+func (err *PatchTestFailedError) Error() string {
+	return fmt.Sprintf("the JSON Patch test of '%v' failed", err.Path)
+}
+
+// applyMergePatch applies an RFC 7396 JSON Merge Patch to target.
+func applyMergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = applyMergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
+
+// applyJsonPatch applies the operations of an RFC 6902 JSON Patch to target
+// in order, failing as a whole if any one of them fails.
+func applyJsonPatch(target interface{}, operations []JsonPatchOperation) (interface{}, error) {
+	var err error
+	for _, operation := range operations {
+		switch operation.Op {
+		case "add":
+			target, err = jsonPointerAdd(target, operation.Path, operation.Value)
+		case "remove":
+			target, _, err = jsonPointerRemove(target, operation.Path)
+		case "replace":
+			if target, _, err = jsonPointerRemove(target, operation.Path); err == nil {
+				target, err = jsonPointerAdd(target, operation.Path, operation.Value)
+			}
+		case "move":
+			var value interface{}
+			if target, value, err = jsonPointerRemove(target, operation.From); err == nil {
+				target, err = jsonPointerAdd(target, operation.Path, value)
+			}
+		case "copy":
+			var value interface{}
+			if value, err = jsonPointerGet(target, operation.From); err == nil {
+				target, err = jsonPointerAdd(target, operation.Path, deepCopyJson(value))
+			}
+		case "test":
+			var value interface{}
+			if value, err = jsonPointerGet(target, operation.Path); err == nil && !jsonEqual(value, operation.Value) {
+				err = &PatchTestFailedError{Path: operation.Path}
+			}
+		default:
+			err = errors.Errorf("unsupported JSON Patch operation '%v'", operation.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return target, nil
+}
+
+// parseJsonPointer splits an RFC 6901 JSON Pointer into unescaped tokens.
+func parseJsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, errors.Errorf("JSON Pointer '%v' must start with '/'", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+func jsonPointerGet(document interface{}, pointer string) (interface{}, error) {
+	tokens, err := parseJsonPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		switch node := document.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, errors.Errorf("path '%v' does not exist", pointer)
+			}
+			document = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, errors.Wrapf(err, "path '%v' does not exist", pointer)
+			}
+			document = node[index]
+		default:
+			return nil, errors.Errorf("path '%v' does not exist", pointer)
+		}
+	}
+	return document, nil
+}
+
+// jsonPointerAdd returns document with value added at pointer, inserting into
+// arrays and replacing existing object members.
+func jsonPointerAdd(document interface{}, pointer string, value interface{}) (interface{}, error) {
+	tokens, err := parseJsonPointer(pointer)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(document, parentPointer)
+	if err != nil {
+		return nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		node[last] = value
+	case []interface{}:
+		index := len(node)
+		if last != "-" {
+			if index, err = arrayIndex(last, len(node)); err != nil {
+				return nil, errors.Wrapf(err, "path '%v' can't be added to", pointer)
+			}
+		}
+		node = append(node[:index], append([]interface{}{value}, node[index:]...)...)
+		return jsonPointerAdd(document, parentPointer, node)
+	default:
+		return nil, errors.Errorf("path '%v' can't be added to", pointer)
+	}
+	return document, nil
+}
+
+// jsonPointerRemove returns document without the value at pointer, along
+// with the removed value.
+func jsonPointerRemove(document interface{}, pointer string) (interface{}, interface{}, error) {
+	tokens, err := parseJsonPointer(pointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil, errors.New("the whole document can't be removed")
+	}
+	parentPointer := pointer[:strings.LastIndex(pointer, "/")]
+	parent, err := jsonPointerGet(document, parentPointer)
+	if err != nil {
+		return nil, nil, err
+	}
+	last := tokens[len(tokens)-1]
+	switch node := parent.(type) {
+	case map[string]interface{}:
+		value, ok := node[last]
+		if !ok {
+			return nil, nil, errors.Errorf("path '%v' does not exist", pointer)
+		}
+		delete(node, last)
+		return document, value, nil
+	case []interface{}:
+		index, err := arrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "path '%v' does not exist", pointer)
+		}
+		value := node[index]
+		node = append(append([]interface{}{}, node[:index]...), node[index+1:]...)
+		document, err = jsonPointerAdd(document, parentPointer, node)
+		return document, value, err
+	default:
+		return nil, nil, errors.Errorf("path '%v' does not exist", pointer)
+	}
+}
+
+func arrayIndex(token string, max int) (int, error) {
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > max || (len(token) > 1 && token[0] == '0') {
+		return -1, errors.Errorf("'%v' is not a valid array index", token)
+	}
+	return index, nil
+}
+
+func deepCopyJson(value interface{}) interface{} {
+	encoded, _ := json.Marshal(value)
+	var copied interface{}
+	json.Unmarshal(encoded, &copied)
+	return copied
+}
+
+func jsonEqual(a interface{}, b interface{}) bool {
+	aEncoded, aErr := json.Marshal(a)
+	bEncoded, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && string(aEncoded) == string(bEncoded)
+}
+
+// applyPlantChanges sets the Plant fields named by their JSON tags in changes.
+func applyPlantChanges(plant Plant, changes map[string]interface{}) (Plant, error) {
+	encoded, err := json.Marshal(plant)
+	if err != nil {
+		return Plant{}, errors.Wrap(err, "Plant to JSON conversion failed")
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		return Plant{}, errors.Wrap(err, "JSON decode failed")
+	}
+	for key, value := range changes {
+		document[key] = value
+	}
+	if encoded, err = json.Marshal(document); err != nil {
+		return Plant{}, errors.Wrap(err, "JSON encode failed")
+	}
+	var changed Plant
+	if err := json.Unmarshal(encoded, &changed); err != nil {
+		return Plant{}, errors.Wrap(err, "JSON to Plant conversion failed")
+	}
+	return changed, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+const (
+	problemContentType = "application/problem+json"
+	problemTypeBase    = "/problems/"
+)
+
+// Problem codes are the stable, machine-readable part of an error response.
+// Clients should branch on these rather than on the detail text.
+const (
+	problemInvalidParameter     = "invalid-parameter"
+	problemInvalidBody          = "invalid-body"
+	problemValidationFailed     = "validation-failed"
+	problemInvalidPatch         = "invalid-patch"
+	problemNotRevertible        = "not-revertible"
+	problemForbidden            = "forbidden"
+	problemNotFound             = "not-found"
+	problemConflict             = "conflict"
+	problemPatchTestFailed      = "patch-test-failed"
+	problemPreconditionFailed   = "precondition-failed"
+	problemRolledBack           = "rolled-back"
+	problemNotAcceptable        = "not-acceptable"
+	problemUnsupportedMediaType = "unsupported-media-type"
+	problemBodyTooLarge         = "body-too-large"
+	problemInternalError        = "internal-error"
+	problemDatabaseUnavailable  = "database-unavailable"
+	problemDatabaseTimeout      = "database-timeout"
+)
+
+// Field error codes say what was wrong with a single field of a request.
+const (
+	fieldErrorRequired     = "required"
+	fieldErrorInvalidValue = "invalid-value"
+	fieldErrorDuplicate    = "duplicate"
+	fieldErrorUnknown      = "unknown"
+	fieldErrorInvalidType  = "invalid-type"
+)
+
+var problemTitles = map[string]string{
+	problemInvalidParameter:     "Invalid parameter",
+	problemInvalidBody:          "Invalid request body",
+	problemValidationFailed:     "Validation failed",
+	problemInvalidPatch:         "Invalid patch",
+	problemNotRevertible:        "Revision can't be reverted to",
+	problemForbidden:            "Forbidden",
+	problemNotFound:             "Not found",
+	problemConflict:             "Conflict",
+	problemPatchTestFailed:      "Patch test failed",
+	problemPreconditionFailed:   "Precondition failed",
+	problemRolledBack:           "Rolled back",
+	problemNotAcceptable:        "Not acceptable",
+	problemUnsupportedMediaType: "Unsupported media type",
+	problemBodyTooLarge:         "Request body too large",
+	problemInternalError:        "Internal error",
+	problemDatabaseUnavailable:  "Database unavailable",
+	problemDatabaseTimeout:      "Database timeout",
+}
+
+// newProblem builds the RFC 7807 problem details for code. The type is a URI
+// reference derived from the code, so the two always agree.
+func newProblem(httpStatusCode int, code string, detail string) ErrorResponse {
+	return ErrorResponse{
+		Type:   problemTypeBase + code,
+		Title:  problemTitles[code],
+		Status: httpStatusCode,
+		Detail: detail,
+		Code:   code,
+	}
+}
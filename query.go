@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+type PlantQuery struct {
+	Filter PlantFilter
+	Sort   []SortField
+	Limit  int
+	Offset int
+}
+
+// SortField orders a query by a Plant field, named by its JSON tag.
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// PlantFilter restricts a query to Plants matching every non-empty field.
+type PlantFilter struct {
+	Name       string
+	NamePrefix string
+	Slug       string
+	Light      LightLevel
+	Humidity   HumidityLevel
+	Water      WaterLevel
+}
+
+func (filter *PlantFilter) Matches(plant Plant) bool {
+	return (filter.Name == "" || plant.Name == filter.Name) &&
+		(filter.NamePrefix == "" || strings.HasPrefix(plant.Name, filter.NamePrefix)) &&
+		(filter.Slug == "" || plantSlug(plant.Name) == filter.Slug) &&
+		(filter.Light == "" || plant.Light == filter.Light) &&
+		(filter.Humidity == "" || plant.Humidity == filter.Humidity) &&
+		(filter.Water == "" || plant.Water == filter.Water)
+}
+
+// plantSlug derives the URL-safe form of a Plant name, with each run of
+// characters other than ASCII letters and digits replaced by a hyphen, so
+// "Dracaena Marginata" becomes "dracaena-marginata".
+func plantSlug(name string) string {
+	return strings.Join(slugWords(name), "-")
+}
+
+func slugWords(name string) []string {
+	return strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+	})
+}
+
+// sortablePlantFields maps the JSON name of each scalar Plant field to its
+// index in the struct. Only these fields may be sorted on.
+var sortablePlantFields = func() map[string]int {
+	fields := make(map[string]int)
+	plantType := reflect.TypeOf(Plant{})
+	for i := 0; i < plantType.NumField(); i++ {
+		field := plantType.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.String, reflect.Int:
+			fields[name] = i
+		}
+	}
+	return fields
+}()
+
+// parseSortFields parses a comma-separated list of field names, each
+// optionally prefixed with '-' for descending order.
+func parseSortFields(value string) ([]SortField, error) {
+	sortFields := make([]SortField, 0)
+	for _, name := range strings.Split(value, ",") {
+		sortField := SortField{Field: strings.TrimPrefix(name, "-"), Descending: strings.HasPrefix(name, "-")}
+		if _, ok := sortablePlantFields[sortField.Field]; !ok {
+			return nil, fmt.Errorf("Plants can't be sorted by '%v'", sortField.Field)
+		}
+		sortFields = append(sortFields, sortField)
+	}
+	return sortFields, nil
+}
+
+// lessPlant orders plants by sortFields, falling back to id order.
+func lessPlant(a Plant, b Plant, sortFields []SortField) bool {
+	aValue, bValue := reflect.ValueOf(a), reflect.ValueOf(b)
+	for _, sortField := range sortFields {
+		aField, bField := aValue.Field(sortablePlantFields[sortField.Field]), bValue.Field(sortablePlantFields[sortField.Field])
+		comparison := 0
+		switch aField.Kind() {
+		case reflect.String:
+			comparison = strings.Compare(aField.String(), bField.String())
+		case reflect.Int:
+			if aField.Int() < bField.Int() {
+				comparison = -1
+			} else if aField.Int() > bField.Int() {
+				comparison = 1
+			}
+		}
+		if comparison != 0 {
+			return (comparison < 0) != sortField.Descending
+		}
+	}
+	return a.Id < b.Id
+}
+
+// applyPlantQuery filters, sorts and pages through plants in memory for backends
+// which can't push the query down to storage. It returns the requested page
+// and the total number of matching plants.
+func applyPlantQuery(plants []Plant, query PlantQuery) ([]Plant, int) {
+	matching := make([]Plant, 0, len(plants))
+	for _, plant := range plants {
+		if query.Filter.Matches(plant) {
+			matching = append(matching, plant)
+		}
+	}
+	plants = matching
+	sort.SliceStable(plants, func(i, j int) bool { return lessPlant(plants[i], plants[j], query.Sort) })
+
+	total := len(plants)
+	start := query.Offset
+	if start < 0 {
+		start = 0
+	} else if start > total {
+		start = total
+	}
+	end := total
+	if query.Limit > 0 && start+query.Limit < total {
+		end = start + query.Limit
+	}
+	return plants[start:end], total
+}
+
+// Matches on a Plant's name count for more than matches on its other names,
+// in line with the weights of the MongoDB text index.
+const (
+	nameSearchWeight      = 2
+	otherNameSearchWeight = 1
+)
+
+// searchPlants ranks plants by how many of the words in text appear in their
+// names, for backends without a text index. Plants matching no words are
+// left out.
+func searchPlants(plants []Plant, text string, limit int) []PlantSearchResult {
+	terms := tokenise(text)
+	results := make([]PlantSearchResult, 0)
+	for _, plant := range plants {
+		nameTokens := tokenSet(plant.Name)
+		otherNameTokens := tokenSet(strings.Join(plant.OtherNames, " "))
+		score := 0.0
+		for _, term := range terms {
+			if nameTokens[term] {
+				score += nameSearchWeight
+			}
+			if otherNameTokens[term] {
+				score += otherNameSearchWeight
+			}
+		}
+		if score > 0 {
+			results = append(results, PlantSearchResult{Plant: plant, Score: score})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Id < results[j].Id
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// tokenise splits text into distinct lower case words.
+func tokenise(text string) []string {
+	tokens := make([]string, 0)
+	for token := range tokenSet(text) {
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+func tokenSet(text string) map[string]bool {
+	tokens := make(map[string]bool)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, word := range words {
+		tokens[word] = true
+	}
+	return tokens
+}
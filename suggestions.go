@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	minSuggestionScore = 0.5
+	didYouMeanScore    = 0.8
+)
+
+// suggestPlantNames returns the names and other names of plants which are
+// closest to name, best first. Names scoring below minScore are left out and
+// each Plant appears at most once, under its best matching name.
+func suggestPlantNames(plants []Plant, name string, limit int, minScore float64) []PlantNameSuggestion {
+	suggestions := make([]PlantNameSuggestion, 0)
+	for _, plant := range plants {
+		best := PlantNameSuggestion{Id: plant.Id, Name: plant.Name}
+		for _, candidate := range append([]string{plant.Name}, plant.OtherNames...) {
+			if score := nameSimilarity(name, candidate); score > best.Score {
+				best.MatchedName = candidate
+				best.Score = score
+			}
+		}
+		if best.Score >= minScore {
+			suggestions = append(suggestions, best)
+		}
+	}
+
+	sort.SliceStable(suggestions, func(i, j int) bool {
+		if suggestions[i].Score != suggestions[j].Score {
+			return suggestions[i].Score > suggestions[j].Score
+		}
+		return suggestions[i].Id < suggestions[j].Id
+	})
+	if limit > 0 && len(suggestions) > limit {
+		suggestions = suggestions[:limit]
+	}
+	return suggestions
+}
+
+// nameSimilarity scores two names between 0 and 1 by their case-insensitive
+// edit distance relative to the length of the longer name.
+func nameSimilarity(a string, b string) float64 {
+	aRunes, bRunes := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	longest := len(aRunes)
+	if len(bRunes) > longest {
+		longest = len(bRunes)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(aRunes, bRunes))/float64(longest)
+}
+
+// levenshtein returns the number of single rune insertions, deletions and
+// substitutions needed to turn a into b.
+func levenshtein(a []rune, b []rune) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
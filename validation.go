@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	validationDocument     openApiDocument
+	validationDocumentOnce sync.Once
+)
+
+// validateRequests checks the query parameters and body of each request
+// against its operation in the OpenAPI document before the handler sees
+// it. Enums aren't checked here, because the handlers accept levels in any
+// case and report values outside the vocabulary themselves.
+func validateRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		operation := routeOperation(r)
+		if operation == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if fieldErrors := validateQuery(r, operation); len(fieldErrors) > 0 {
+			log.Println("The query parameters are invalid: ", fieldErrorMessages(fieldErrors))
+			problem := newProblem(400, problemInvalidParameter, fieldErrorMessages(fieldErrors))
+			problem.Errors = fieldErrors
+			writeProblem(w, r, problem)
+			return
+		}
+
+		if operation.RequestBody != nil {
+			// The body is buffered, so it's capped to keep one request from
+			// using up the memory
+			maxBytes := viper.GetInt64("Server.MaxBodyBytes")
+			if maxBytes > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+			body, err := io.ReadAll(r.Body)
+			if err != nil && maxBytes > 0 && int64(len(body)) >= maxBytes {
+				log.Printf("The request body is larger than %v bytes\n", maxBytes)
+				writeErrorResponse(w, r, 413, problemBodyTooLarge, fmt.Sprintf("The request body must be at most %v bytes", maxBytes))
+				return
+			}
+			if err != nil {
+				log.Printf("The request body could not be read: %v\n", err)
+				writeErrorResponse(w, r, 400, problemInvalidBody, "The request body could not be read")
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			if fieldErrors := validateBody(r, body, operation); len(fieldErrors) > 0 {
+				log.Println("The request body is invalid: ", fieldErrorMessages(fieldErrors))
+				writeValidationErrorResponse(w, r, fieldErrors)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// routeOperation finds the documented operation of the route the request
+// matched, if there is one.
+func routeOperation(r *http.Request) *openApiOperation {
+	validationDocumentOnce.Do(func() { validationDocument = newOpenApiDocument() })
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return nil
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return nil
+	}
+	return validationDocument.Paths[path][strings.ToLower(r.Method)]
+}
+
+func validateQuery(r *http.Request, operation *openApiOperation) []FieldError {
+	parameters := make(map[string]openApiParameter)
+	for _, parameter := range operation.Parameters {
+		if parameter.In == "query" {
+			parameters[parameter.Name] = parameter
+		}
+	}
+
+	query := r.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fieldErrors := make([]FieldError, 0)
+	for _, name := range names {
+		parameter, ok := parameters[name]
+		if !ok {
+			fieldErrors = append(fieldErrors, FieldError{Field: name, Code: fieldErrorUnknown, Message: fmt.Sprintf("The query parameter '%v' is not supported", name)})
+			continue
+		}
+		if !queryValueHasType(query.Get(name), parameter.Schema.Type) {
+			fieldErrors = append(fieldErrors, FieldError{Field: name, Code: fieldErrorInvalidType, Message: fmt.Sprintf("The %v parameter must be %v", name, typeDescription(parameter.Schema.Type))})
+		}
+	}
+	for _, parameter := range operation.Parameters {
+		if parameter.In == "query" && parameter.Required && query.Get(parameter.Name) == "" {
+			fieldErrors = append(fieldErrors, FieldError{Field: parameter.Name, Code: fieldErrorRequired, Message: fmt.Sprintf("The %v parameter is required", parameter.Name)})
+		}
+	}
+	return fieldErrors
+}
+
+func queryValueHasType(value string, schemaType string) bool {
+	var err error
+	switch schemaType {
+	case "integer":
+		_, err = strconv.Atoi(value)
+	case "boolean":
+		_, err = strconv.ParseBool(value)
+	}
+	return err == nil
+}
+
+// validateBody checks body against the schema for its content type. Bodies
+// which can't be parsed at all are left to the handler to report, as are
+// XML bodies, which have no generic form to check.
+func validateBody(r *http.Request, body []byte, operation *openApiOperation) []FieldError {
+	contentType := r.Header.Get("content-type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if contentType == "" {
+		mediaType = jsonCodec.contentType()
+	}
+	content, ok := operation.RequestBody.Content[mediaType]
+	if !ok {
+		// Codecs accept aliases of the documented content types
+		codec, ok := requestCodec(r)
+		if !ok {
+			return nil
+		}
+		if content, ok = operation.RequestBody.Content[codec.contentType()]; !ok {
+			return nil
+		}
+		mediaType = codec.contentType()
+	}
+
+	var document interface{}
+	switch {
+	case mediaType == jsonCodec.contentType() || strings.HasSuffix(mediaType, "+json"):
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if decoder.Decode(&document) != nil {
+			return nil
+		}
+	case mediaType == yamlCodec.contentType():
+		if yaml.Unmarshal(body, &document) != nil {
+			return nil
+		}
+		document = normaliseYaml(document)
+	case mediaType == msgpackCodec.contentType():
+		if msgpackCodec.decode(bytes.NewReader(body), &document) != nil {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	fieldErrors := make([]FieldError, 0)
+	validateValue(document, content.Schema, "", "", &fieldErrors)
+	return fieldErrors
+}
+
+// validateValue appends an error to fieldErrors for each part of value at
+// pointer which doesn't match schema. field is the name of the innermost
+// property containing it.
+func validateValue(value interface{}, schema *openApiSchema, pointer string, field string, fieldErrors *[]FieldError) {
+	if schema.Ref != "" {
+		schema = validationDocument.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	if schema.Type == "" || (value == nil && schema.Nullable) {
+		return
+	}
+	if !valueHasType(value, schema.Type) {
+		*fieldErrors = append(*fieldErrors, FieldError{
+			Field:   field,
+			Pointer: pointer,
+			Code:    fieldErrorInvalidType,
+			Message: fmt.Sprintf("The value at '%v' must be %v", pointer, typeDescription(schema.Type)),
+		})
+		return
+	}
+
+	switch schema.Type {
+	case "array":
+		for i, item := range value.([]interface{}) {
+			validateValue(item, schema.Items, pointer+"/"+strconv.Itoa(i), field, fieldErrors)
+		}
+	case "object":
+		if schema.Properties == nil {
+			return
+		}
+		object := value.(map[string]interface{})
+		names := make([]string, 0, len(object))
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			propertyPointer := pointer + "/" + escapeJsonPointer(name)
+			property, ok := schema.Properties[name]
+			if !ok {
+				*fieldErrors = append(*fieldErrors, FieldError{
+					Field:   name,
+					Pointer: propertyPointer,
+					Code:    fieldErrorUnknown,
+					Message: fmt.Sprintf("The field '%v' is not allowed", propertyPointer),
+				})
+				continue
+			}
+			validateValue(object[name], property, propertyPointer, name, fieldErrors)
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				fieldError := requiredFieldError(name)
+				fieldError.Pointer = pointer + "/" + escapeJsonPointer(name)
+				*fieldErrors = append(*fieldErrors, fieldError)
+			}
+		}
+	}
+}
+
+func valueHasType(value interface{}, schemaType string) bool {
+	switch schemaType {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "integer":
+		switch number := value.(type) {
+		case json.Number:
+			_, err := number.Int64()
+			return err == nil
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			return true
+		}
+		return false
+	case "number":
+		switch value.(type) {
+		case json.Number, float32, float64, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			return true
+		}
+		return false
+	}
+	return true
+}
+
+func typeDescription(schemaType string) string {
+	switch schemaType {
+	case "object", "array", "integer":
+		return "an " + schemaType
+	}
+	return "a " + schemaType
+}
+
+// escapeJsonPointer escapes a reference token of an RFC 6901 JSON Pointer.
+func escapeJsonPointer(token string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+}
+
+// normaliseYaml converts the maps YAML decodes into the string keyed maps
+// JSON decodes into, so both can be checked the same way.
+func normaliseYaml(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		object := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			object[fmt.Sprint(key)] = normaliseYaml(item)
+		}
+		return object
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = normaliseYaml(item)
+		}
+	}
+	return value
+}
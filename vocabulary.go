@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type LightLevel string
+type HumidityLevel string
+type WaterLevel string
+
+const (
+	LightLow            LightLevel = "low"
+	LightMedium         LightLevel = "medium"
+	LightBrightIndirect LightLevel = "bright indirect"
+	LightBrightDirect   LightLevel = "bright direct"
+
+	HumidityLow      HumidityLevel = "low"
+	HumidityModerate HumidityLevel = "moderate"
+	HumidityHigh     HumidityLevel = "high"
+
+	WaterLow      WaterLevel = "low"
+	WaterModerate WaterLevel = "moderate"
+	WaterHigh     WaterLevel = "high"
+)
+
+// The canonical values of each level, in increasing order.
+var (
+	lightVocabulary    = []string{string(LightLow), string(LightMedium), string(LightBrightIndirect), string(LightBrightDirect)}
+	humidityVocabulary = []string{string(HumidityLow), string(HumidityModerate), string(HumidityHigh)}
+	waterVocabulary    = []string{string(WaterLow), string(WaterModerate), string(WaterHigh)}
+)
+
+// Levels are parsed case-insensitively into their canonical values, from
+// every request format. Values outside the vocabulary are kept as they are,
+// so Validate can report them.
+func (level *LightLevel) UnmarshalText(text []byte) error {
+	*level = LightLevel(canonicalLevel(string(text), lightVocabulary))
+	return nil
+}
+
+func (level *HumidityLevel) UnmarshalText(text []byte) error {
+	*level = HumidityLevel(canonicalLevel(string(text), humidityVocabulary))
+	return nil
+}
+
+func (level *WaterLevel) UnmarshalText(text []byte) error {
+	*level = WaterLevel(canonicalLevel(string(text), waterVocabulary))
+	return nil
+}
+
+func (level LightLevel) IsValid() bool {
+	return inVocabulary(string(level), lightVocabulary)
+}
+
+func (level HumidityLevel) IsValid() bool {
+	return inVocabulary(string(level), humidityVocabulary)
+}
+
+func (level WaterLevel) IsValid() bool {
+	return inVocabulary(string(level), waterVocabulary)
+}
+
+// levelField is one of the levels of a Plant along with its vocabulary, so
+// that the three can be checked together.
+type levelField struct {
+	name       string
+	value      string
+	valid      bool
+	vocabulary []string
+}
+
+func levelFields(light LightLevel, humidity HumidityLevel, water WaterLevel) []levelField {
+	return []levelField{
+		{"light", string(light), light.IsValid(), lightVocabulary},
+		{"humidity", string(humidity), humidity.IsValid(), humidityVocabulary},
+		{"water", string(water), water.IsValid(), waterVocabulary},
+	}
+}
+
+// canonicalLevel returns the vocabulary entry matching value regardless of
+// case and spacing, or value itself if there isn't one.
+func canonicalLevel(value string, vocabulary []string) string {
+	normalised := strings.Join(strings.Fields(strings.ToLower(value)), " ")
+	if inVocabulary(normalised, vocabulary) {
+		return normalised
+	}
+	return value
+}
+
+func inVocabulary(value string, vocabulary []string) bool {
+	for _, allowed := range vocabulary {
+		if value == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func vocabularyMessage(field string, vocabulary []string) string {
+	return fmt.Sprintf("The %v value must be one of: %v", field, strings.Join(vocabulary, ", "))
+}